@@ -0,0 +1,237 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"project-proxy/events"
+	"project-proxy/logs"
+	"project-proxy/metrics"
+	"project-proxy/server"
+)
+
+var log = logs.GetLoggerForModule("admin")
+
+type api struct {
+	registry server.Registry
+	token    string
+}
+
+// NewHandler serves the JSON admin API under /api/. A non-empty token is required as "Authorization: Bearer <token>".
+//
+//	GET    /api/agents               connected agents
+//	DELETE /api/agents/{name}        disconnect an agent
+//	GET    /api/connections          active tunneled connections
+//	DELETE /api/connections/{id}     forcibly close a connection
+//	GET    /api/traffic              per-service connection and byte totals
+//	GET    /api/events               stream of events, one JSON object per line
+//	GET    /api/log-levels           log levels per module and scoped log levels
+//	PUT    /api/log-levels           change a log level, see LevelChange
+func NewHandler(registry server.Registry, token string) http.Handler {
+	return &api{
+		registry: registry,
+		token:    token,
+	}
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "agents" && r.Method == http.MethodGet:
+		a.listAgents(w)
+	case len(parts) == 2 && parts[0] == "agents" && r.Method == http.MethodDelete:
+		a.disconnectAgent(w, parts[1])
+	case path == "connections" && r.Method == http.MethodGet:
+		a.listConnections(w)
+	case len(parts) == 2 && parts[0] == "connections" && r.Method == http.MethodDelete:
+		a.closeConnection(w, parts[1])
+	case path == "traffic" && r.Method == http.MethodGet:
+		a.listTraffic(w)
+	case path == "events" && r.Method == http.MethodGet:
+		a.streamEvents(w, r)
+	case path == "log-levels" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, logs.GetLevels())
+	case path == "log-levels" && r.Method == http.MethodPut:
+		a.changeLogLevel(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (a *api) listAgents(w http.ResponseWriter) {
+	agents := []server.AgentInfo{}
+	for _, s := range a.registry.GetServers() {
+		agents = append(agents, s.GetAgentInfo())
+	}
+	writeJSON(w, http.StatusOK, agents)
+}
+
+func (a *api) disconnectAgent(w http.ResponseWriter, name string) {
+	for _, s := range a.registry.GetServers() {
+		if s.GetAgentInfo().Name == name {
+			log.Warningf("Disconnecting agent: %s on admin request", name)
+			s.Disconnect()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown agent: "+name)
+}
+
+func (a *api) listConnections(w http.ResponseWriter) {
+	conns := []server.ConnectionInfo{}
+	for _, s := range a.registry.GetServers() {
+		conns = append(conns, s.GetConnections()...)
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (a *api) closeConnection(w http.ResponseWriter, idString string) {
+	id, err := strconv.ParseUint(idString, 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id: "+idString)
+		return
+	}
+	for _, s := range a.registry.GetServers() {
+		if s.CloseConnection(uint32(id)) {
+			log.Warningf("Closed connection id: %d on admin request", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown connection id: "+idString)
+}
+
+type ServiceTraffic struct {
+	Service           string `json:"service"`
+	ActiveConnections uint64 `json:"activeConnections"`
+	TotalConnections  uint64 `json:"totalConnections"`
+	BytesIn           uint64 `json:"bytesIn"`
+	BytesOut          uint64 `json:"bytesOut"`
+}
+
+// listTraffic sums the tunnel metrics of every agent per service.
+func (a *api) listTraffic(w http.ResponseWriter) {
+	byService := make(map[string]*ServiceTraffic)
+	get := func(service string) *ServiceTraffic {
+		if byService[service] == nil {
+			byService[service] = &ServiceTraffic{Service: service}
+		}
+		return byService[service]
+	}
+	for _, sample := range metrics.ConnectionsActive.Samples() {
+		get(sample.LabelValues[0]).ActiveConnections += uint64(sample.Value)
+	}
+	for _, sample := range metrics.ConnectionsTotal.Samples() {
+		get(sample.LabelValues[0]).TotalConnections += uint64(sample.Value)
+	}
+	for _, sample := range metrics.BytesTotal.Samples() {
+		if sample.LabelValues[0] == metrics.DirectionIn {
+			get(sample.LabelValues[1]).BytesIn += uint64(sample.Value)
+		} else {
+			get(sample.LabelValues[1]).BytesOut += uint64(sample.Value)
+		}
+	}
+	traffic := []ServiceTraffic{}
+	for _, t := range byService {
+		traffic = append(traffic, *t)
+	}
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].Service < traffic[j].Service
+	})
+	writeJSON(w, http.StatusOK, traffic)
+}
+
+func (a *api) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-ch:
+			err := enc.Encode(e)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// LevelChange sets the level of a module, of the records carrying Field with Value (e.g. "conn_id" and "123" or
+// "agent" and "nas") or, if neither is given, the default level. An empty or "reset" level removes the change.
+type LevelChange struct {
+	Module string `json:"module,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Level  string `json:"level"`
+}
+
+func (a *api) changeLogLevel(w http.ResponseWriter, r *http.Request) {
+	var change LevelChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid log level change: "+err.Error())
+		return
+	}
+	if change.Module != "" && change.Field != "" {
+		writeError(w, http.StatusBadRequest, "a log level change applies either to a module or to a field")
+		return
+	}
+	reset := change.Level == "" || change.Level == "reset"
+	level := 0
+	if !reset {
+		level, err = logs.ParseLevel(change.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	switch {
+	case change.Field != "" && reset:
+		logs.ClearScopedLevel(change.Field, change.Value)
+	case change.Field != "":
+		logs.SetScopedLevel(change.Field, change.Value, level)
+	case reset:
+		logs.ResetModuleLevel(change.Module)
+	default:
+		logs.SetModuleLevel(change.Module, level)
+	}
+	log.Noticef("Changed the log level on admin request - module: %q field: %q value: %q level: %q",
+		change.Module, change.Field, change.Value, change.Level)
+	writeJSON(w, http.StatusOK, logs.GetLevels())
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Warningf("Could not write an admin API response. Cause: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,155 @@
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"project-proxy/events"
+	"project-proxy/logs"
+	"project-proxy/server"
+)
+
+type client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Client talks to the admin API of a server.
+type Client interface {
+	GetAgents() ([]server.AgentInfo, error)
+	GetConnections() ([]server.ConnectionInfo, error)
+	GetTraffic() ([]ServiceTraffic, error)
+	CloseConnection(id uint32) error
+	DisconnectAgent(name string) error
+	TailEvents(onEvent func(e events.Event)) error
+	GetLogLevels() (logs.Levels, error)
+	SetLogLevel(change LevelChange) (logs.Levels, error)
+}
+
+// NewClient creates a client for the admin API at address. A nil config talks plain HTTP.
+func NewClient(address string, token string, config *tls.Config) Client {
+	scheme := "http"
+	transport := &http.Transport{}
+	if config != nil {
+		scheme = "https"
+		transport.TLSClientConfig = config
+	}
+	return &client{
+		baseURL:    scheme + "://" + address + "/api/",
+		token:      token,
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+func (c *client) do(method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiError)
+		return nil, fmt.Errorf("%s %s failed with %s: %s", method, path, resp.Status, apiError.Error)
+	}
+	return resp, nil
+}
+
+func (c *client) get(path string, value interface{}) error {
+	resp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func (c *client) delete(path string) error {
+	resp, err := c.do(http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *client) GetAgents() ([]server.AgentInfo, error) {
+	var agents []server.AgentInfo
+	return agents, c.get("agents", &agents)
+}
+
+func (c *client) GetConnections() ([]server.ConnectionInfo, error) {
+	var conns []server.ConnectionInfo
+	return conns, c.get("connections", &conns)
+}
+
+func (c *client) GetTraffic() ([]ServiceTraffic, error) {
+	var traffic []ServiceTraffic
+	return traffic, c.get("traffic", &traffic)
+}
+
+func (c *client) CloseConnection(id uint32) error {
+	return c.delete("connections/" + strconv.FormatUint(uint64(id), 10))
+}
+
+func (c *client) DisconnectAgent(name string) error {
+	return c.delete("agents/" + name)
+}
+
+func (c *client) GetLogLevels() (logs.Levels, error) {
+	var levels logs.Levels
+	return levels, c.get("log-levels", &levels)
+}
+
+// SetLogLevel applies a change and returns the levels in effect afterwards.
+func (c *client) SetLogLevel(change LevelChange) (logs.Levels, error) {
+	var levels logs.Levels
+	body, err := json.Marshal(change)
+	if err != nil {
+		return levels, err
+	}
+	resp, err := c.do(http.MethodPut, "log-levels", bytes.NewReader(body))
+	if err != nil {
+		return levels, err
+	}
+	defer resp.Body.Close()
+	return levels, json.NewDecoder(resp.Body).Decode(&levels)
+}
+
+// TailEvents calls onEvent for every event until the server ends the stream.
+func (c *client) TailEvents(onEvent func(e events.Event)) error {
+	resp, err := c.do(http.MethodGet, "events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var e events.Event
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return err
+		}
+		onEvent(e)
+	}
+}
@@ -0,0 +1,38 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig returns the config of the admin API over TLS: the server presents the certificate of base and only
+// accepts clients with a certificate signed by the admin CA in caFile. The admin CA must not have signed
+// agentCertificate, since that certificate ships with every agent binary.
+func NewTLSConfig(base *tls.Config, caFile string, agentCertificate string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	block, _ := pem.Decode([]byte(agentCertificate))
+	if block != nil {
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			_, err = certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+			if err == nil {
+				return nil, errors.New("the admin CA signed the built-in agent certificate")
+			}
+		}
+	}
+	config := base.Clone()
+	config.ClientCAs = roots
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"project-proxy/certs"
+	"project-proxy/metrics"
+	"project-proxy/tracing"
 	"time"
 	"project-proxy/messaging"
 	"flag"
@@ -9,62 +13,300 @@ import (
 	"project-proxy/agent"
 	"project-proxy/logs"
 	"project-proxy/connectivity"
+	"project-proxy/health"
+	"net"
+	"context"
+	"os/signal"
+	"syscall"
 )
 
+// exitCodeGaveUp is the exit code of an agent that reached control-conn-max-attempts.
+const exitCodeGaveUp = 3
+
 func main() {
-	controlConnNetworkType := flag.String("control-conn-net-type", "tcp", "The network type of the control connection")
-	controlConnAddress := flag.String("control-conn-addr", ":9001", "The ip_addr:port combination of the control connection")
-	controlConnRestartInterval := flag.Int("control-conn-reset-interval", 1000, "Waiting time in ms before attempting to restart the control connection")
+	controlConnNetworkType := flag.String("control-conn-net-type", "tcp", "The network type of the control connection (tcp, ws or wss)")
+	controlConnAddress := flag.String("control-conn-addr", ":9001", "Comma separated ip_addr:port combinations of the servers' control connections, tried as control-conn-policy decides")
+	controlConnSRV := flag.String("control-conn-srv", "", "DNS SRV name (e.g. _proxy._tcp.example.com) listing the servers' control connections, looked up before every connection attempt. Overrides control-conn-addr")
+	controlConnPolicy := flag.String("control-conn-policy", "priority", "Order the servers are tried in: priority (as listed or by SRV priority and weight), round-robin or rtt (fastest control connection handshake first)")
+	controlConnFailback := flag.Int("control-conn-failback-interval", 0, "Interval in ms at which an agent connected to a less preferred server checks whether a preferred one is reachable again and moves back to it. Under rtt, another server must answer at least twice as fast as the current one. Does not apply to round-robin. Setting this to zero disables moving back")
+	controlConnRestartInterval := flag.Int("control-conn-reset-interval", 1000, "Initial waiting time in ms before attempting to restart the control connection. Each failed attempt multiplies it by control-conn-reset-multiplier up to control-conn-reset-max-interval; the actual wait is a random time up to it")
+	controlConnRestartMaxInterval := flag.Int("control-conn-reset-max-interval", 60000, "Max waiting time in ms before attempting to restart the control connection")
+	controlConnRestartMultiplier := flag.Float64("control-conn-reset-multiplier", 2, "Factor the waiting time grows by after each failed attempt to restart the control connection. 1 keeps it constant")
+	controlConnStableAfter := flag.Int("control-conn-stable-after", 60000, "Time in ms after which a control connection counts as stable, resetting the waiting time and the attempt count")
+	controlConnMaxAttempts := flag.Int("control-conn-max-attempts", 0, "Number of attempts in a row without a stable control connection after which the agent gives up and exits with code 3. Setting this to zero retries forever")
 	controlConnPingInterval := flag.Int("control-conn-ping-interval", 30000, "Waiting time in ms between pings to keep the control connection alive. Setting this to zero disables pinging")
 	controlConnPingTimeout := flag.Int("control-conn-ping-timeout", 45000, "Max waiting time in ms for a ping message before the control connection gets closed and re-established. Setting this to zero disables timeout")
-	transferConnNetworkType := flag.String("transfer-conn-net-type", "tcp", "The network type of the transfer connections")
-	transferConnAddress := flag.String("transfer-conn-addr", ":8888", "The ip_addr:port combination of the transfer connections")
-	localConnNetworkType := flag.String("local-conn-net-type", "tcp", "The network type of the incoming client connections")
-	localConnAddress := flag.String("local-conn-addr", ":80", "The ip_addr:port combination of the incoming client connections")
+	controlConnMaxMissedPongs := flag.Int("control-conn-max-missed-pongs", 3, "Number of pings in a row left unanswered after which the peer is considered dead and the control connection gets re-established. Setting this to zero disables the check")
+	controlConnWsPath := flag.String("control-conn-ws-path", "/control", "The HTTP path of the control connection when using the ws or wss network type")
+	transferConnNetworkType := flag.String("transfer-conn-net-type", "tcp", "The network type of the transfer connections (tcp, ws or wss)")
+	transferConnAddress := flag.String("transfer-conn-addr", ":8888", "The ip_addr:port combination of the transfer connections, a comma separated list matching control-conn-addr, or a :port used on the host of whichever server holds the control connection")
+	transferConnWsPath := flag.String("transfer-conn-ws-path", "/transfer", "The HTTP path of the transfer connections when using the ws or wss network type. Control and transfer connections can share an address if their paths differ")
+	localConnNetworkType := flag.String("local-conn-net-type", "tcp", "The network type of the local connections (tcp, unix or unixpacket)")
+	localConnAddress := flag.String("local-conn-addr", ":80", "The ip_addr:port combination (or the unix socket path, '@name' for the abstract namespace) of the local connections")
+	egressProxy := flag.String("egress-proxy", "", "URL of an HTTP CONNECT (http://, https://) or SOCKS5 (socks5://, socks5h://) proxy for control and transfer connections, optionally with user:password. Empty uses HTTPS_PROXY or ALL_PROXY, 'direct' disables proxying")
+	egressNoProxy := flag.String("egress-no-proxy", "", "Comma separated hosts, domains and CIDRs reached without the egress proxy. Empty uses NO_PROXY")
+	agentName := flag.String("agent-name", "", "The name this agent announces to the server. Defaults to the host name")
+	serviceName := flag.String("service-name", "default", "The name of the service behind local-conn-addr, as requested by clients")
+	lanAllow := flag.String("lan-allow", "", "Comma separated host[:ports] entries (names, *.domains, IPs or CIDRs; ports as *, N or N-M) the server's SOCKS5 front-end may reach through this agent. The list is announced to the server, which routes SOCKS5 connections to agents whose list may permit the destination. Empty disables LAN access")
 	bufferSize := flag.Uint64("buffer-size", 512, "Size of the buffer (in KB) used to read from and write to local connections")
+	streamQueueSize := flag.Int64("stream-queue-size", agent.DefaultStreamQueueBytes/1024, "Size (in KB) of the data received for a connection forwarded over the control connection that may wait for its slow local connection. A connection overflowing it is shed (closed), not paused. Must be positive")
+	streamQueueTotalSize := flag.Int64("stream-queue-total-size", agent.DefaultStreamQueueTotalBytes/1024, "Size (in KB) of the data that may wait for all slow local connections together. Further connections falling behind are shed (closed), not paused. Must be positive")
+	localHealthCheck := flag.String("local-health-check", "", "How the local target is probed: tcp (connect), http (GET local-health-http-path, a status below 400 passes) or expect (send local-health-send, wait for local-health-expect). The server refuses connections for an unhealthy target. Empty disables probing")
+	localHealthInterval := flag.Int("local-health-interval", 10000, "Waiting time in ms between probes of the local target")
+	localHealthTimeout := flag.Int("local-health-timeout", 5000, "Max time in ms a probe of the local target may take")
+	localHealthFailures := flag.Int("local-health-failures", 2, "Number of failed probes in a row after which the local target is reported unhealthy. A single passed probe reports it healthy again")
+	localHealthHTTPPath := flag.String("local-health-http-path", "/", "The HTTP path requested by the http probe")
+	localHealthSend := flag.String("local-health-send", "", "What the expect probe sends after connecting, e.g. PING\\r\\n. Go escape sequences are interpreted")
+	localHealthExpect := flag.String("local-health-expect", "", "What the expect probe waits for in the answer of the local target, e.g. SSH- for sshd. Go escape sequences are interpreted. Empty passes once connected and sent")
+	metricsAddress := flag.String("metrics-addr", "", "The ip_addr:port combination serving Prometheus metrics at /metrics. Empty disables it")
+	healthAddress := flag.String("health-addr", "", "The ip_addr:port combination serving liveness at /healthz and readiness at /readyz. Ready means the control connection is established, was recently ponged and local-conn-addr is reachable (or passes local-health-check). Empty disables it")
+	traceExport := flag.String("trace-export", "", "Where connection setup spans are exported: an OTLP/HTTP traces URL (e.g. http://127.0.0.1:4318/v1/traces) or a file path. Empty disables tracing")
 	logLevel := flag.Int("log-level", 4, "Log levels: 0 CRITICAL, 1 ERROR, 2 WARNING, 3 NOTICE, 4 INFO, 5 DEBUG")
-	usePlainTcpTransferConns := flag.Bool("tcp-transfer-conns", false, "If true, uses plain TCP (instead of TLS) for transfer connections. This is usually a bad idea")
+	logModuleLevels := flag.String("log-module-levels", "", "Comma separated module=level pairs overriding log-level for single modules, e.g. server=5,proxy=2. Modules: main, server, agent, client, mess, mess_ovr, proxy, admin, health, logs. On unix SIGUSR1 makes the default level more verbose and SIGUSR2 restores the startup levels")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logSink := flag.String("log-sink", "stdout", "Where the logs are written: stdout, stderr, file, syslog or journald")
+	logFile := flag.String("log-file", "", "Path of the log file used by the file log sink")
+	logFileMaxSize := flag.Int("log-file-max-size", 100, "Size in MB after which the log file is rotated. Setting this to zero disables rotation")
+	logFileMaxBackups := flag.Int("log-file-max-backups", 5, "Number of rotated log files kept")
+	dialTimeout := flag.Int("dial-timeout", 30000, "Max time in ms to establish a connection before the attempt is given up. Setting this to zero disables the timeout")
+	handshakeTimeout := flag.Int("handshake-timeout", 10000, "Max time in ms for the TLS and WebSocket handshakes of a connection, both connecting and accepting. Setting this to zero disables the timeout")
+	tcpKeepAlive := flag.Int("tcp-keepalive-interval", 0, "Interval in ms of TCP keep-alive probes. Zero uses the system default (15000), a negative value disables them")
+	usePlainTcpTransferConns := flag.Bool("tcp-transfer-conns", false, "If true, uses plain TCP (instead of TLS) for tcp control and transfer connections. This is usually a bad idea")
 
 	envy.Parse("APP")
 	flag.Parse()
 
-	logs.Init(*logLevel)
+	err := logs.InitWithOptions(logs.Options{
+		Level:          *logLevel,
+		ModuleLevels:   *logModuleLevels,
+		Format:         *logFormat,
+		Sink:           *logSink,
+		File:           *logFile,
+		FileMaxSizeMB:  *logFileMaxSize,
+		FileMaxBackups: *logFileMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up logging. Cause: %s\n", err)
+		os.Exit(1)
+	}
+	connOptions := connectivity.ConnOptions{
+		DialTimeout:      time.Duration(*dialTimeout) * time.Millisecond,
+		HandshakeTimeout: time.Duration(*handshakeTimeout) * time.Millisecond,
+		KeepAlive:        time.Duration(*tcpKeepAlive) * time.Millisecond,
+	}
+	logs.HandleLevelSignals()
 	log := logs.GetLoggerForModule("main")
 
-	var controlCf connectivity.ConnFactory
-	var transferCf connectivity.ConnFactory
+	if *traceExport != "" {
+		exporter, err := tracing.NewExporter(*traceExport)
+		if err != nil {
+			log.Fatalf("Could not set up the trace exporter. Cause: %s", err)
+		}
+		tracing.SetExporter(exporter, "project-proxy-agent")
+		log.Infof("Exporting traces to %s", *traceExport)
+	}
+
+	if *metricsAddress != "" {
+		err := connectivity.HandleHTTP(nil, *metricsAddress, connOptions, "/metrics", metrics.Handler())
+		if err != nil {
+			log.Fatalf("Could not serve metrics. Cause: %s", err)
+		}
+		log.Infof("Serving metrics at %s/metrics", *metricsAddress)
+	}
+
+	tlsConfig := connectivity.NewTLSConfig(certs.RootCertificate, certs.ServerPrivateKey, certs.ServerCertificate, true)
 	if *usePlainTcpTransferConns {
-		controlCf = connectivity.NewTCPConnectionFactory(*controlConnNetworkType, *controlConnAddress)
-		transferCf = connectivity.NewTCPConnectionFactory(*transferConnNetworkType, *transferConnAddress)
 		log.Warning("Plain TCP is used for transfer connections. Please check if this is as intended")
+	}
+
+	proxyURL, noProxy := connectivity.EgressProxyFromEnvironment()
+	if *egressProxy != "" {
+		proxyURL = *egressProxy
+	}
+	if *egressNoProxy != "" {
+		noProxy = *egressNoProxy
+	}
+	var dialer connectivity.Dialer
+	if proxyURL != "" && proxyURL != "direct" {
+		dialer, err = connectivity.NewEgressProxyDialer(proxyURL, noProxy, connOptions)
+		if err != nil {
+			log.Fatalf("Could not configure the egress proxy. Cause: %s", err)
+		}
+		log.Infof("Control and transfer connections will be dialed through an egress proxy (bypassed for: %s)", noProxy)
+	}
+	tunnelFactory := func(networkType string, address string, wsPath string) connectivity.ConnFactory {
+		cf := connectivity.NewTunnelConnectionFactory(tlsConfig, *usePlainTcpTransferConns, networkType, address, wsPath)
+		cf.SetOptions(connOptions)
+		if dialer != nil {
+			cf.SetDialer(dialer)
+		}
+		return cf
+	}
+
+	servers := func() ([]agent.ServerAddress, error) {
+		return agent.ParseServerList(*controlConnAddress, *transferConnAddress)
+	}
+	if *controlConnSRV != "" {
+		servers = func() ([]agent.ServerAddress, error) {
+			return agent.ResolveSRV(*controlConnSRV, *transferConnAddress)
+		}
+	} else if _, err := servers(); err != nil {
+		log.Fatalf("Could not parse the server list. Cause: %s", err)
+	}
+	connectControl := func(ctx context.Context, server agent.ServerAddress) (net.Conn, error) {
+		return tunnelFactory(*controlConnNetworkType, server.Control, *controlConnWsPath).ConnectContext(ctx)
+	}
+	selector, err := agent.NewServerSelector(*controlConnPolicy, servers, connectControl)
+	if err != nil {
+		log.Fatalf("Could not set up server selection. Cause: %s", err)
+	}
+
+	var localCf connectivity.ConnFactory
+	if connectivity.IsUnixNetworkType(*localConnNetworkType) {
+		localCf = connectivity.NewUnixConnectionFactory(*localConnNetworkType, *localConnAddress, "", 0)
 	} else {
-		controlCf = connectivity.NewTLSConnectionFactory(certs.RootCertificate, certs.ServerPrivateKey,
-			certs.ServerCertificate, true, *controlConnNetworkType, *controlConnAddress)
-		transferCf = connectivity.NewTLSConnectionFactory(certs.RootCertificate, certs.ServerPrivateKey,
-			certs.ServerCertificate, true, *transferConnNetworkType, *transferConnAddress)
+		localCf = connectivity.NewTCPConnectionFactory(*localConnNetworkType, *localConnAddress)
+	}
+	localCf.SetOptions(connOptions)
+
+	if *agentName == "" {
+		*agentName, _ = os.Hostname()
+	}
+
+	if *streamQueueSize <= 0 || *streamQueueTotalSize <= 0 {
+		log.Fatalf("The stream queue sizes need to be positive")
+	}
+
+	var localProbe agent.Probe
+	if *localHealthCheck != "" {
+		localProbe, err = agent.NewProbe(*localHealthCheck, localCf, agent.ProbeOptions{
+			HTTPPath: *localHealthHTTPPath,
+			Send:     *localHealthSend,
+			Expect:   *localHealthExpect,
+		})
+		if err != nil {
+			log.Fatalf("Could not set up the local health check. Cause: %s", err)
+		}
+		if *localHealthInterval <= 0 || *localHealthTimeout <= 0 {
+			log.Fatalf("The local health check needs a positive interval and timeout")
+		}
 	}
 
-	localCf := connectivity.NewTCPConnectionFactory(*localConnNetworkType, *localConnAddress)
+	allowList, err := connectivity.ParseAllowList(*lanAllow)
+	if err != nil {
+		log.Fatalf("Could not parse the LAN allow-list. Cause: %s", err)
+	}
+
+	controlConnHealth := &health.ControlConn{}
+	if *healthAddress != "" {
+		checker := health.NewChecker()
+		maxSilence := time.Duration(*controlConnPingInterval) * time.Millisecond * time.Duration(*controlConnMaxMissedPongs+1)
+		checker.AddReadinessCheck("control_connection", controlConnHealth.Check(maxSilence))
+		if localProbe != nil {
+			checker.AddReadinessCheck("local_target", func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*localHealthTimeout)*time.Millisecond)
+				defer cancel()
+				return localProbe.Check(ctx)
+			})
+		} else {
+			checker.AddReadinessCheck("local_target", health.Reachable(localCf))
+		}
+		for _, pattern := range []string{"/healthz", "/readyz"} {
+			err := connectivity.HandleHTTP(nil, *healthAddress, connOptions, pattern, checker.Handler())
+			if err != nil {
+				log.Fatalf("Could not serve the health endpoints. Cause: %s", err)
+			}
+		}
+		log.Infof("Serving health endpoints at %s/healthz and %s/readyz", *healthAddress, *healthAddress)
+	}
 
-	for {
-		log.Infof("Trying to establish a type: %s control connection with a server at: %s", *controlConnNetworkType, *controlConnAddress)
-		conn, err := controlCf.Connect()
+	// Interrupting the agent aborts connecting and waiting, and ends the current control connection.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reconnectBackoff := agent.NewBackoff(time.Duration(*controlConnRestartInterval)*time.Millisecond,
+		time.Duration(*controlConnRestartMaxInterval)*time.Millisecond, *controlConnRestartMultiplier)
+	stableAfter := time.Duration(*controlConnStableAfter) * time.Millisecond
+	sessionToken := agent.NewSessionToken()
+	connectedBefore := false
+	// failed counts the attempts in a row that did not end in a stable control connection.
+	failed := 0
+	for ctx.Err() == nil {
+		conn, server, err := agent.ConnectServer(selector, func(server agent.ServerAddress) (net.Conn, error) {
+			log.Infof("Trying to establish a type: %s control connection with a server at: %s", *controlConnNetworkType, server.Control)
+			return connectControl(ctx, server)
+		})
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			break
+		}
 		if err != nil {
-			log.Errorf("Could not connect to the server. Cause: %s", err)
+			log.Errorf("Could not connect to any server. Cause: %s", err)
+			failed++
 		} else {
-			log.Infof("Successfully connected to the server. Starting the agent")
+			log.Infof("Successfully connected to the server at: %s Starting the agent", server.Control)
+			transferCf := tunnelFactory(*transferConnNetworkType, server.Transfer, *transferConnWsPath)
+			if connectedBefore {
+				metrics.ControlReconnectsTotal.Inc()
+			}
+			connectedBefore = true
 			mess := messaging.NewMessenger(conn)
 			mess.SetTimeout(time.Duration(*controlConnPingTimeout) * time.Millisecond)
+			overlay := messaging.NewMessengerOverlay(mess)
+			overlay.SetMaxMissedPongs(*controlConnMaxMissedPongs)
 			a := agent.NewAgent(localCf, transferCf,
 				time.Duration(*controlConnPingInterval)*time.Millisecond,
-				*bufferSize*uint64(1024), messaging.NewMessengerOverlay(mess))
+				*bufferSize*uint64(1024), overlay)
+			a.SetAllowList(allowList)
+			a.SetLANConnOptions(connOptions)
+			a.SetIdentity(*agentName, *serviceName)
+			a.SetSessionToken(sessionToken)
+			a.SetStreamQueueLimits(*streamQueueSize*1024, *streamQueueTotalSize*1024)
+			if localProbe != nil {
+				a.SetLocalHealthCheck(localProbe, time.Duration(*localHealthInterval)*time.Millisecond,
+					time.Duration(*localHealthTimeout)*time.Millisecond, *localHealthFailures)
+			}
+			started := time.Now()
 			a.Start()
+			controlConnHealth.Connected(overlay)
+			stopFailback := make(chan bool)
+			if *controlConnFailback > 0 {
+				go agent.FailBack(selector, server, a, time.Duration(*controlConnFailback)*time.Millisecond, stopFailback)
+			}
+			go func() {
+				select {
+				case <-ctx.Done():
+					a.Disconnect()
+				case <-stopFailback:
+				}
+			}()
 			a.Wait()
+			close(stopFailback)
+			controlConnHealth.Disconnected()
+			if ctx.Err() != nil {
+				break
+			}
 			log.Warningf("The agent has finished. This usually means connectivity or server problems. Reconnecting")
+			if time.Since(started) >= stableAfter {
+				reconnectBackoff.Reset()
+				failed = 0
+			} else {
+				failed++
+			}
+		}
+		if *controlConnMaxAttempts > 0 && failed >= *controlConnMaxAttempts {
+			log.Errorf("Giving up after %d attempts without a stable control connection", failed)
+			os.Exit(exitCodeGaveUp)
+		}
+		sleepingTime := reconnectBackoff.Next()
+		log.Warningf("Waiting for %d ms to reconnect to the server (attempt: %d)", sleepingTime/time.Millisecond, reconnectBackoff.Attempts())
+		select {
+		case <-ctx.Done():
+		case <-time.After(sleepingTime):
 		}
-		sleepingTime := time.Duration(*controlConnRestartInterval) * time.Millisecond
-		log.Warningf("Waiting for %d ms to reconnect to the server", sleepingTime/time.Millisecond)
-		time.Sleep(sleepingTime)
 	}
-
+	log.Warningf("The agent was interrupted. Exiting")
 }
+
@@ -1,12 +1,20 @@
 package agent
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net"
+	"sync"
 	"project-proxy/messaging"
 	"time"
 	"project-proxy/logs"
 	"encoding/binary"
 	"project-proxy/connectivity"
+	"project-proxy/metrics"
+	"project-proxy/tracing"
+	"project-proxy/version"
 )
 
 type agent struct {
@@ -15,25 +23,51 @@ type agent struct {
 	transferConnFactory connectivity.ConnFactory
 	pingInterval        time.Duration
 	bufferSize          uint64
-	localConns          map[uint32]net.Conn
+	streams             map[uint32]*stream
+	streamsMutex        sync.Mutex
+	streamBudget        streamBudget
+	allowList           connectivity.AllowList
+	lanConnOptions      connectivity.ConnOptions
+	agentName           string
+	serviceName         string
+	sessionToken        string
+	probe               Probe
+	probeInterval       time.Duration
+	probeTimeout        time.Duration
+	probeFailures       int
+	ctx                 context.Context
+	cancel              context.CancelFunc
 	waitUntilFinished   chan bool
 }
 
 type Agent interface {
 	Start()
 	Wait()
+	SetAllowList(allowList connectivity.AllowList)
+	SetLANConnOptions(options connectivity.ConnOptions)
+	SetIdentity(agentName string, serviceName string)
+	SetSessionToken(sessionToken string)
+	SetStreamQueueLimits(streamBytes int64, totalBytes int64)
+	SetLocalHealthCheck(probe Probe, interval time.Duration, timeout time.Duration, failures int)
+	Disconnect()
 }
 
 var log = logs.GetLoggerForModule("agent")
 
 func NewAgent(localConnFactory connectivity.ConnFactory, tranferConnFactory connectivity.ConnFactory, pingInterval time.Duration, bufferSize uint64, overlay messaging.MessengerOverlay) Agent {
+	// ctx is cancelled once the control connection is lost, aborting connections still being opened for it.
+	ctx, cancel := context.WithCancel(context.Background())
 	return &agent{
 		messenger:           overlay,
 		localConnFactory:    localConnFactory,
 		transferConnFactory: tranferConnFactory,
 		pingInterval:        pingInterval,
 		bufferSize:          bufferSize,
-		localConns:          make(map[uint32]net.Conn),
+		streams:             make(map[uint32]*stream),
+		streamBudget:        streamBudget{streamBytes: DefaultStreamQueueBytes, totalBytes: DefaultStreamQueueTotalBytes},
+		lanConnOptions:      connectivity.DefaultConnOptions(),
+		ctx:                 ctx,
+		cancel:              cancel,
 		waitUntilFinished:   make(chan bool),
 	}
 }
@@ -41,78 +75,81 @@ func NewAgent(localConnFactory connectivity.ConnFactory, tranferConnFactory conn
 func (a *agent) Start() {
 	onReceive := func(id uint32, service uint32, payload []byte, err error) () {
 		if err != nil {
-			log.Warningf("Received an erroreous message - id: %d , service: %d This message will be ignored. Cause: %s", id, service, err)
+			log.With(logs.FieldConnId, id).Warningf("Received an erroreous message - service: %d This message will be ignored. Cause: %s", service, err)
 			return
 		}
-		log.Debugf("Received a forward message - id: %d , service: %d, len: %d", id, service, len(payload))
-		localConn := a.localConns[id]
-		if localConn == nil {
-			log.Infof("Connection with id: %d not found. Opening new local connection", id)
-			localConn, err = a.localConnFactory.Connect()
-			if err != nil {
-				log.Errorf("Error while opening new local connection. Sending request to close remote connection. Cause: %s", err)
-				a.messenger.SendCloseConn(id)
-			}
-			a.localConns[id] = localConn
-			go func() {
-				log.Infof("Creating a new buffer of %d bytes for a new local connection id: %d", a.bufferSize, id)
-				buffer := make([]byte, a.bufferSize)
-				for {
-					len, err := localConn.Read(buffer)
-					log.Debugf("Read %d bytes from local connection id: %d", len, id)
-					if err != nil {
-						log.Errorf("Error while reading local connection id: %d Closing local connection. Sending request to close remote connection. Cause: %s", id, err)
-						localConn.Close()
-						delete(a.localConns, id)
-						a.messenger.SendCloseConn(id)
-						return
-					} else if len == 0 {
-						log.Warningf("Read no bytes from local connection id: %d This usually indicates a timeout. Closing local connection. Sending request to close remote connection", id)
-						localConn.Close()
-						delete(a.localConns, id)
-						a.messenger.SendCloseConn(id)
-						return
-					}
-					log.Debugf("Sending %d bytes to the server", len)
-					a.messenger.SendForward(id, service, buffer[:len])
-				}
-			}()
-		}
-		log.Debugf("Writing bytes (total: %d) to local connection id: %d", len(payload), id)
-		length, err := localConn.Write(payload)
+		a.connLog(id).Debugf("Received a forward message - service: %d, len: %d", service, len(payload))
+		a.forward(id, service, payload)
+	}
+	onOpenConn := func(remoteConnId uint32, service uint32, destination string, traceParent string, err error) {
 		if err != nil {
-			log.Errorf("Error while writing to local connection. Closing local connection. Sending request to close remote connection. Cause: %s", err)
-			localConn.Close()
-			delete(a.localConns, id)
-			a.messenger.SendCloseConn(id)
-			return
-		} else if length == 0 {
-			log.Warningf("Written no bytes to local connection id: %d This usually indicates a timeout. Closing local connection. Sending request to close remote connection", id)
-			localConn.Close()
-			delete(a.localConns, id)
-			a.messenger.SendCloseConn(id)
+			log.Errorf("Erroreous request to open a local connection. This message will be ignored. Cause: %s", err)
 			return
 		}
-		log.Debugf("Successfully written %d of %d bytes to a local connection id: %d", length, len(payload), id)
-	}
-	onOpenConn := func(remoteConnId uint32, service uint32, err error) {
+		started := time.Now()
+		clog := a.connLog(remoteConnId)
+		parent, err := tracing.ParseTraceParent(traceParent)
 		if err != nil {
-			log.Errorf("Erroreous request to open a local connection. This message will be ignored. Cause: %s", err)
+			clog.Warningf("Ignoring the trace context of the request. Cause: %s", err)
+		}
+		span := a.startTrace(remoteConnId, destination, parent)
+		step := span.StartChild("local.dial", tracing.KindClient)
+		var localConn net.Conn
+		if destination == "" {
+			localConn, err = a.localConnFactory.ConnectContext(a.ctx)
+		} else {
+			localConn, err = a.connectDestination(destination)
+		}
+		step.EndWithError(err)
+		if err != nil {
+			span.EndWithError(err)
+			clog.Errorf("Error while opening new local connection. Sending request to close remote connection. Cause: %s", err)
+			if errors.Is(err, connectivity.ErrNotAllowed) {
+				metrics.OpenFailuresTotal.Inc("destination_not_allowed")
+			} else {
+				metrics.OpenFailuresTotal.Inc("local_dial")
+			}
+			a.messenger.SendCloseConn(remoteConnId)
 			return
 		}
-		transferConn, err := a.transferConnFactory.Connect()
+		step = span.StartChild("transfer.dial", tracing.KindClient)
+		transferConn, err := a.transferConnFactory.ConnectContext(a.ctx)
+		step.EndWithError(err)
 		if err != nil {
-			log.Errorf("Transfer connection could not be established. This message will be ignored. Cause: %s", err)
+			span.EndWithError(err)
+			clog.Errorf("Transfer connection could not be established. Closing local connection. Sending request to close remote connection. Cause: %s", err)
+			metrics.OpenFailuresTotal.Inc("transfer_dial")
+			localConn.Close()
+			a.messenger.SendCloseConn(remoteConnId)
 			return
 		}
 		binary.Write(transferConn, binary.LittleEndian, remoteConnId)
 
-		localConn, err := a.localConnFactory.Connect()
-		if err != nil {
-			log.Errorf("Error while opening new local connection. Closing transfer connection. Cause: %s", err)
-			transferConn.Close()
-		}
+		metrics.ConnectionOpenSeconds.Observe(time.Since(started).Seconds(), a.serviceName, a.agentName)
+		metrics.ConnectionsTotal.Inc(a.serviceName, a.agentName)
+		metrics.ConnectionsActive.Inc(a.serviceName, a.agentName)
 		p := connectivity.NewConnProxy(transferConn, localConn)
+		p.SetLogFields(clog.Fields()...)
+		step = span.StartChild("first_byte", tracing.KindInternal)
+		var firstByte sync.Once
+		p.SetOnTransferListener(func(aToB int, bToA int) {
+			firstByte.Do(func() {
+				step.End()
+				span.End()
+			})
+			if aToB > 0 {
+				metrics.BytesTotal.Add(float64(aToB), metrics.DirectionIn, a.serviceName, a.agentName)
+			}
+			if bToA > 0 {
+				metrics.BytesTotal.Add(float64(bToA), metrics.DirectionOut, a.serviceName, a.agentName)
+			}
+		})
+		p.SetOnFinishedListener(func(connA net.Conn, connB net.Conn, reason connectivity.CloseReason) {
+			metrics.ConnectionsActive.Dec(a.serviceName, a.agentName)
+			err := errors.New("closed before the first byte: " + string(reason))
+			step.EndWithError(err)
+			span.EndWithError(err)
+		})
 		p.RunAsync()
 	}
 	onCloseConn := func(remoteConnId uint32, err error) {
@@ -120,25 +157,25 @@ func (a *agent) Start() {
 			log.Errorf("Erroreous request to close a local connection. This message will be ignored. Cause: %s", err)
 			return
 		}
-		log.Infof("Received a request to close a local connection id: %d", remoteConnId)
-		conn := a.localConns[remoteConnId]
-		if conn == nil {
-			log.Warningf("Cannot close local connection id: %d Unknown connection. This message will be ignored", remoteConnId)
+		clog := a.connLog(remoteConnId)
+		clog.Infof("Received a request to close the local connection")
+		s := a.removeStream(remoteConnId, nil)
+		if s == nil {
+			clog.Warningf("Cannot close local connection. Unknown connection. This message will be ignored")
 			return
 		}
-		log.Infof("Closing local connection connection id: %d", remoteConnId)
-		error := conn.Close()
-		delete(a.localConns, remoteConnId)
-		if error != nil {
-			log.Warningf("Closing a local connection id: %d failed. Connection was removed from the connection list. Cause: %s", error)
-			return
-		}
-		log.Infof("Successfuly closed local connection id: %d", remoteConnId)
+		clog.Infof("Closing the local connection once the data queued for it is written")
+		s.finish()
 	}
 	onControlConnLost := func(err error) {
-		log.Errorf("Control connection lost. Closing all local connections. Signalling that the agent has finished. Cause: %s", err)
-		for _, v := range a.localConns {
-			v.Close()
+		log.With(logs.FieldAgent, a.agentName, logs.FieldService, a.serviceName).Errorf("Control connection lost. Closing the local connections forwarded over it, proxied connections keep running until the server resumes or drops them. Signalling that the agent has finished. Cause: %s", err)
+		a.cancel()
+		a.streamsMutex.Lock()
+		streams := a.streams
+		a.streams = make(map[uint32]*stream)
+		a.streamsMutex.Unlock()
+		for _, s := range streams {
+			s.close()
 		}
 		a.waitUntilFinished <- true
 	}
@@ -146,9 +183,19 @@ func (a *agent) Start() {
 	a.messenger.SetOnOpenConnectionListener(onOpenConn)
 	a.messenger.SetOnCloseConnectionListener(onCloseConn)
 	a.messenger.SetOnControlConnectionLostListener(onControlConnLost)
+	a.messenger.SetOnPongListener(func(rtt time.Duration, stats messaging.RTTStats) {
+		metrics.ControlRTTSeconds.Observe(rtt.Seconds(), a.agentName)
+		metrics.ControlRTTJitterSeconds.Set(stats.Jitter.Seconds(), a.agentName)
+	})
 
-	log.Infof("Starting agent - network type: %s, local connections address: %s, control connection ping interval: %d", a.localConnFactory.GetNetworkType(), a.localConnFactory.GetAddress(), a.pingInterval)
+	log.Infof("Starting agent - local connections address: %s, control connection ping interval: %d", connectivity.DescribeAddress(a.localConnFactory.GetNetworkType(), a.localConnFactory.GetAddress()), a.pingInterval)
 	a.messenger.Start()
+	log.Infof("Announcing agent: %s with service: %s", a.agentName, a.serviceName)
+	a.messenger.SendHello(a.agentName, a.serviceName, version.Version, a.sessionToken, a.allowList.String())
+	if a.probe != nil {
+		log.Infof("The local target will be probed every %d ms", a.probeInterval/time.Millisecond)
+		go a.runProbes()
+	}
 	if a.pingInterval > 0 {
 		log.Infof("The server will be pinged every %d ms", a.pingInterval/time.Millisecond)
 		a.startKeepAlive()
@@ -157,6 +204,73 @@ func (a *agent) Start() {
 	}
 }
 
+func (a *agent) SetAllowList(allowList connectivity.AllowList) {
+	a.allowList = allowList
+}
+
+// SetLANConnOptions sets the options of the connections opened to destinations requested through SOCKS5.
+func (a *agent) SetLANConnOptions(options connectivity.ConnOptions) {
+	a.lanConnOptions = options
+}
+
+func (a *agent) SetIdentity(agentName string, serviceName string) {
+	a.agentName = agentName
+	a.serviceName = serviceName
+}
+
+// SetSessionToken sets the token announced in the hello message. Reconnecting with the token of the previous control
+// connection lets the server re-attach the connections that survived its loss.
+func (a *agent) SetSessionToken(sessionToken string) {
+	a.sessionToken = sessionToken
+}
+
+// NewSessionToken returns a random token identifying the session of an agent process across control connections.
+func NewSessionToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Warningf("Could not generate a session token. Sessions will not be resumed. Cause: %s", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// connectDestination dials a destination requested through the server's SOCKS5 front-end, provided the allow-list permits it.
+func (a *agent) connectDestination(destination string) (net.Conn, error) {
+	address, err := a.allowList.Resolve(destination)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Opening a LAN connection to %s (requested: %s)", address, destination)
+	factory := connectivity.NewTCPConnectionFactory("tcp", address)
+	factory.SetOptions(a.lanConnOptions)
+	return factory.ConnectContext(a.ctx)
+}
+
+// startTrace starts the span of opening a connection, joining the server's trace if it sent one. The steps
+// local.dial, transfer.dial and first_byte are its children.
+func (a *agent) startTrace(id uint32, destination string, parent tracing.SpanContext) *tracing.Span {
+	span := tracing.StartSpan("agent.open_connection", tracing.KindServer, parent)
+	span.SetAttribute("conn_id", id)
+	span.SetAttribute("service", a.serviceName)
+	span.SetAttribute("agent", a.agentName)
+	if destination != "" {
+		span.SetAttribute("destination", destination)
+	}
+	return span
+}
+
+// connLog returns a logger carrying the fields of connection id.
+func (a *agent) connLog(id uint32) *logs.Logger {
+	return log.With(logs.FieldConnId, id, logs.FieldService, a.serviceName, logs.FieldAgent, a.agentName)
+}
+
+// Disconnect closes the control connection, which ends the agent like any other connectivity loss.
+func (a *agent) Disconnect() {
+	log.Warningf("Disconnecting from the server")
+	a.messenger.Close()
+}
+
 func (a *agent) Wait() {
 	<-a.waitUntilFinished
 	log.Infof("The agent has finished")
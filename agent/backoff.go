@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delays between reconnection attempts: exponential growth from the initial delay up to the
+// maximum, with full jitter (a random delay between zero and the current ceiling) so that agents losing the same
+// server do not reconnect in lockstep.
+type Backoff interface {
+	// Next returns the delay before the next attempt and counts the attempt.
+	Next() time.Duration
+	// Reset starts over from the initial delay, e.g. after a stable session.
+	Reset()
+	// Attempts returns the number of attempts since the last reset.
+	Attempts() int
+}
+
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	ceiling    time.Duration
+	attempts   int
+	random     *rand.Rand
+}
+
+func NewBackoff(initial time.Duration, max time.Duration, multiplier float64) Backoff {
+	if max < initial {
+		max = initial
+	}
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	return &backoff{
+		initial:    initial,
+		max:        max,
+		multiplier: multiplier,
+		ceiling:    initial,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *backoff) Next() time.Duration {
+	b.attempts++
+	ceiling := b.ceiling
+	next := time.Duration(float64(b.ceiling) * b.multiplier)
+	if next > b.max || next < b.ceiling {
+		next = b.max
+	}
+	b.ceiling = next
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(b.random.Int63n(int64(ceiling) + 1))
+}
+
+func (b *backoff) Reset() {
+	b.ceiling = b.initial
+	b.attempts = 0
+}
+
+func (b *backoff) Attempts() int {
+	return b.attempts
+}
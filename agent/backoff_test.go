@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffCeilings(t *testing.T) {
+	tests := []struct {
+		name       string
+		initial    time.Duration
+		max        time.Duration
+		multiplier float64
+		ceilings   []float64
+	}{
+		{"doubling", time.Second, 10 * time.Second, 2, []float64{1, 2, 4, 8, 10, 10}},
+		{"constant", time.Second, 10 * time.Second, 1, []float64{1, 1, 1}},
+		{"multiplier below 1", time.Second, 10 * time.Second, 0.5, []float64{1, 1, 1}},
+		{"max below initial", 3 * time.Second, time.Second, 2, []float64{3, 3, 3}},
+		{"fractional multiplier", 2 * time.Second, 5 * time.Second, 1.5, []float64{2, 3, 4.5, 5, 5}},
+	}
+	for _, test := range tests {
+		b := NewBackoff(test.initial, test.max, test.multiplier)
+		for i, seconds := range test.ceilings {
+			ceiling := time.Duration(seconds * float64(time.Second))
+			if got := b.(*backoff).ceiling; got != ceiling {
+				t.Errorf("%s: attempt %d has a ceiling of %s, expected %s", test.name, i+1, got, ceiling)
+			}
+			delay := b.Next()
+			if delay < 0 || delay > ceiling {
+				t.Errorf("%s: attempt %d waits %s, beyond the ceiling of %s", test.name, i+1, delay, ceiling)
+			}
+			if b.Attempts() != i+1 {
+				t.Errorf("%s: %d attempts counted after %d", test.name, b.Attempts(), i+1)
+			}
+		}
+	}
+}
+
+func TestBackoffJitterReachesCeiling(t *testing.T) {
+	b := NewBackoff(time.Second, time.Second, 1)
+	var longest time.Duration
+	for i := 0; i < 1000; i++ {
+		if delay := b.Next(); delay > longest {
+			longest = delay
+		}
+	}
+	if longest < 900*time.Millisecond {
+		t.Fatalf("The longest of 1000 delays with a ceiling of 1s was %s", longest)
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := NewBackoff(time.Second, time.Minute, 2)
+	for i := 0; i < 5; i++ {
+		b.Next()
+	}
+	b.Reset()
+	if b.Attempts() != 0 {
+		t.Fatalf("%d attempts counted after a reset", b.Attempts())
+	}
+	for i := 0; i < 100; i++ {
+		if delay := b.Next(); delay > time.Second {
+			t.Fatalf("The first delay after a reset was %s, beyond the initial delay", delay)
+		}
+		b.Reset()
+	}
+}
+
+func TestBackoffWithoutDelay(t *testing.T) {
+	b := NewBackoff(0, 0, 2)
+	for i := 0; i < 3; i++ {
+		if delay := b.Next(); delay != 0 {
+			t.Fatalf("A backoff without delays waited %s", delay)
+		}
+	}
+}
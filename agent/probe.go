@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+	"project-proxy/metrics"
+	"project-proxy/version"
+)
+
+// Kinds of local target probes.
+const (
+	ProbeTCP    = "tcp"
+	ProbeHTTP   = "http"
+	ProbeExpect = "expect"
+)
+
+// maxExpectBytes bounds how much of the target's answer an expect probe reads while looking for the expected string.
+const maxExpectBytes = 64 * 1024
+
+var errExpectNotFound = errors.New("the expected answer was not received")
+
+// Probe checks whether the local target of the agent is able to serve connections.
+type Probe interface {
+	// Check returns an error if the target failed the probe. It gives up once ctx is done.
+	Check(ctx context.Context) error
+}
+
+// ProbeOptions configure the probes that talk to the target. Send and Expect may hold Go escape sequences such as \r\n.
+type ProbeOptions struct {
+	HTTPPath string
+	Send     string
+	Expect   string
+}
+
+type tcpProbe struct {
+	factory connectivity.ConnFactory
+}
+
+type httpProbe struct {
+	factory connectivity.ConnFactory
+	path    string
+}
+
+type expectProbe struct {
+	factory connectivity.ConnFactory
+	send    []byte
+	expect  []byte
+}
+
+// NewProbe returns a probe of the given kind whose connections are made with factory: tcp only connects, http sends
+// a GET request and expects a status below 400, expect sends Send, if any, and waits for Expect, if any.
+func NewProbe(kind string, factory connectivity.ConnFactory, options ProbeOptions) (Probe, error) {
+	switch kind {
+	case ProbeTCP:
+		return &tcpProbe{factory: factory}, nil
+	case ProbeHTTP:
+		path := options.HTTPPath
+		if path == "" {
+			path = "/"
+		}
+		return &httpProbe{factory: factory, path: path}, nil
+	case ProbeExpect:
+		send, err := unescape(options.Send)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string to send: %s", err)
+		}
+		expect, err := unescape(options.Expect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string to expect: %s", err)
+		}
+		return &expectProbe{factory: factory, send: []byte(send), expect: []byte(expect)}, nil
+	}
+	return nil, fmt.Errorf("unknown probe: %q", kind)
+}
+
+func unescape(s string) (string, error) {
+	return strconv.Unquote(`"` + s + `"`)
+}
+
+// connect opens a connection for a probe whose deadline is the one of ctx.
+func connect(ctx context.Context, factory connectivity.ConnFactory) (net.Conn, error) {
+	conn, err := factory.ConnectContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+func (p *tcpProbe) Check(ctx context.Context) error {
+	conn, err := connect(ctx, p.factory)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *httpProbe) Check(ctx context.Context) error {
+	conn, err := connect(ctx, p.factory)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// A unix socket path is no host, so requests to unix targets go to localhost.
+	host := p.factory.GetAddress()
+	if connectivity.IsUnixNetworkType(p.factory.GetNetworkType()) {
+		host = "localhost"
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+p.path, nil)
+	if err != nil {
+		return err
+	}
+	request.Close = true
+	request.Header.Set("User-Agent", "project-proxy-agent/"+version.Version)
+	if err := request.Write(conn); err != nil {
+		return err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return nil
+}
+
+func (p *expectProbe) Check(ctx context.Context) error {
+	conn, err := connect(ctx, p.factory)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(p.send) > 0 {
+		if _, err := conn.Write(p.send); err != nil {
+			return err
+		}
+	}
+	if len(p.expect) == 0 {
+		return nil
+	}
+	var received []byte
+	buffer := make([]byte, 4096)
+	for len(received) < maxExpectBytes {
+		n, err := conn.Read(buffer)
+		received = append(received, buffer[:n]...)
+		if bytes.Contains(received, p.expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", errExpectNotFound, err)
+		}
+	}
+	return errExpectNotFound
+}
+
+// SetLocalHealthCheck makes the agent probe its local target every interval, each probe taking at most timeout, and
+// report to the server whenever the target turns healthy or unhealthy. The target turns unhealthy after the given
+// number of failed probes in a row and healthy again after a single passed one.
+func (a *agent) SetLocalHealthCheck(probe Probe, interval time.Duration, timeout time.Duration, failures int) {
+	a.probe = probe
+	a.probeInterval = interval
+	a.probeTimeout = timeout
+	a.probeFailures = failures
+}
+
+// runProbes probes the local target until the control connection is lost. The first result is always reported, as
+// the server considers a target healthy until told otherwise.
+func (a *agent) runProbes() {
+	plog := log.With(logs.FieldAgent, a.agentName, logs.FieldService, a.serviceName)
+	ticker := time.NewTicker(a.probeInterval)
+	defer ticker.Stop()
+	failed := 0
+	reported, healthy := false, false
+	for {
+		ctx, cancel := context.WithTimeout(a.ctx, a.probeTimeout)
+		err := a.probe.Check(ctx)
+		cancel()
+		if a.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failed = 0
+		} else {
+			failed++
+		}
+		switch {
+		case err == nil && (!reported || !healthy):
+			plog.Infof("The local target is healthy. Reporting it to the server")
+			reported, healthy = true, true
+			metrics.TargetHealthy.Set(1, a.serviceName, a.agentName)
+			a.messenger.SendServiceHealth(true, "")
+		case err != nil && failed >= a.probeFailures && (!reported || healthy):
+			plog.Warningf("The local target failed %d probes in a row. Reporting it as unhealthy to the server. Cause: %s", failed, err)
+			reported, healthy = true, false
+			metrics.TargetHealthy.Set(0, a.serviceName, a.agentName)
+			a.messenger.SendServiceHealth(false, err.Error())
+		case err != nil:
+			plog.Debugf("The local target failed a probe (%d in a row). Cause: %s", failed, err)
+		}
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
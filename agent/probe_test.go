@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+	"project-proxy/connectivity"
+)
+
+func TestNewProbe(t *testing.T) {
+	factory := connectivity.NewTCPConnectionFactory("tcp", "127.0.0.1:80")
+	tests := []struct {
+		kind    string
+		options ProbeOptions
+		probe   Probe
+		fails   bool
+	}{
+		{ProbeTCP, ProbeOptions{}, &tcpProbe{factory: factory}, false},
+		{ProbeHTTP, ProbeOptions{}, &httpProbe{factory: factory, path: "/"}, false},
+		{ProbeHTTP, ProbeOptions{HTTPPath: "/healthz"}, &httpProbe{factory: factory, path: "/healthz"}, false},
+		{ProbeExpect, ProbeOptions{}, &expectProbe{factory: factory, send: []byte{}, expect: []byte{}}, false},
+		{ProbeExpect, ProbeOptions{Send: `PING\r\n`, Expect: "+PONG"},
+			&expectProbe{factory: factory, send: []byte("PING\r\n"), expect: []byte("+PONG")}, false},
+		{ProbeExpect, ProbeOptions{Send: `\x00\x01`, Expect: `say \"hi\"`},
+			&expectProbe{factory: factory, send: []byte{0, 1}, expect: []byte(`say "hi"`)}, false},
+		{ProbeExpect, ProbeOptions{Send: `\q`}, nil, true},
+		{ProbeExpect, ProbeOptions{Expect: `\x0`}, nil, true},
+		{ProbeExpect, ProbeOptions{Expect: `trailing\`}, nil, true},
+		{"udp", ProbeOptions{}, nil, true},
+		{"", ProbeOptions{}, nil, true},
+	}
+	for _, test := range tests {
+		probe, err := NewProbe(test.kind, factory, test.options)
+		if (err != nil) != test.fails {
+			t.Errorf("%q %+v: unexpected error: %v", test.kind, test.options, err)
+			continue
+		}
+		if !test.fails && !reflect.DeepEqual(probe, test.probe) {
+			t.Errorf("%q %+v: got %+v, expected %+v", test.kind, test.options, probe, test.probe)
+		}
+	}
+}
+
+func TestHTTPProbeOfUnixTarget(t *testing.T) {
+	path := t.TempDir() + "/target.sock"
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "localhost" || r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	probe, err := NewProbe(ProbeHTTP, connectivity.NewUnixConnectionFactory("unix", path, "", 0), ProbeOptions{HTTPPath: "/healthz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := probe.Check(ctx); err != nil {
+		t.Fatalf("The HTTP probe of a unix target failed: %s", err)
+	}
+}
@@ -0,0 +1,313 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server selection policies.
+const (
+	PolicyPriority   = "priority"
+	PolicyRoundRobin = "round-robin"
+	PolicyRTT        = "rtt"
+)
+
+const probeTimeout = 2 * time.Second
+
+// rttFailBackFactor is how many times faster than the current server another one must answer for the agent to move
+// to it under the rtt policy, so that measurements close to each other do not make it move back and forth.
+const rttFailBackFactor = 2
+
+// ServerAddress is a server the agent can hold its control session with, together with the address its transfer
+// connections go to.
+type ServerAddress struct {
+	Control  string
+	Transfer string
+}
+
+func (s ServerAddress) String() string {
+	return s.Control
+}
+
+// ServerSelector decides which servers the agent tries, in which order.
+type ServerSelector interface {
+	// Candidates returns the servers in the order they should be tried.
+	Candidates() ([]ServerAddress, error)
+	// Connected records the server the control connection was established with.
+	Connected(server ServerAddress)
+	// Preferred returns a server the agent should move back to from current, if it is reachable.
+	Preferred(current ServerAddress) (ServerAddress, bool)
+}
+
+type serverSelector struct {
+	policy  string
+	servers func() ([]ServerAddress, error)
+	connect func(ctx context.Context, server ServerAddress) (net.Conn, error)
+	next    int
+	mutex   sync.Mutex
+}
+
+// NewServerSelector applies a policy to the servers returned by servers, which is called on every selection so that
+// e.g. DNS SRV records are looked up again. Servers are probed with connect, which should establish a control
+// connection the way the agent does, handshakes included.
+func NewServerSelector(policy string, servers func() ([]ServerAddress, error), connect func(ctx context.Context, server ServerAddress) (net.Conn, error)) (ServerSelector, error) {
+	switch policy {
+	case PolicyPriority, PolicyRoundRobin, PolicyRTT:
+	default:
+		return nil, errors.New("unknown server selection policy: " + policy)
+	}
+	return &serverSelector{
+		policy:  policy,
+		servers: servers,
+		connect: connect,
+	}, nil
+}
+
+func (s *serverSelector) Candidates() ([]ServerAddress, error) {
+	servers, err := s.servers()
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no servers to connect to")
+	}
+	switch s.policy {
+	case PolicyRoundRobin:
+		s.mutex.Lock()
+		start := s.next % len(servers)
+		s.mutex.Unlock()
+		return append(append([]ServerAddress(nil), servers[start:]...), servers[:start]...), nil
+	case PolicyRTT:
+		return s.byRTT(servers), nil
+	default:
+		return servers, nil
+	}
+}
+
+func (s *serverSelector) Connected(server ServerAddress) {
+	if s.policy != PolicyRoundRobin {
+		return
+	}
+	servers, err := s.servers()
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, candidate := range servers {
+		if candidate == server {
+			s.next = i + 1
+			return
+		}
+	}
+}
+
+// Preferred returns the first server ahead of current in priority order that answers a probe. Under the rtt policy it
+// is the fastest server, if it answers rttFailBackFactor times faster than current. Round robin has no preferred
+// server.
+func (s *serverSelector) Preferred(current ServerAddress) (ServerAddress, bool) {
+	switch s.policy {
+	case PolicyRoundRobin:
+		return ServerAddress{}, false
+	case PolicyRTT:
+		return s.faster(current)
+	}
+	candidates, err := s.Candidates()
+	if err != nil {
+		return ServerAddress{}, false
+	}
+	for _, candidate := range candidates {
+		if candidate == current {
+			return ServerAddress{}, false
+		}
+		if _, err := s.probe(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return ServerAddress{}, false
+}
+
+// faster returns the fastest server if it answers rttFailBackFactor times faster than current.
+func (s *serverSelector) faster(current ServerAddress) (ServerAddress, bool) {
+	servers, err := s.servers()
+	if err != nil || len(servers) == 0 {
+		return ServerAddress{}, false
+	}
+	rtts := s.measure(servers)
+	currentRTT := probeTimeout
+	fastest := -1
+	for i, server := range servers {
+		if server == current {
+			currentRTT = rtts[i]
+		} else if fastest < 0 || rtts[i] < rtts[fastest] {
+			fastest = i
+		}
+	}
+	if fastest < 0 || rtts[fastest] >= probeTimeout || rtts[fastest]*rttFailBackFactor > currentRTT {
+		return ServerAddress{}, false
+	}
+	return servers[fastest], true
+}
+
+// byRTT orders the servers by the time establishing a control connection with them takes. Unreachable servers go last.
+func (s *serverSelector) byRTT(servers []ServerAddress) []ServerAddress {
+	rtts := s.measure(servers)
+	ordered := make([]int, len(servers))
+	for i := range ordered {
+		ordered[i] = i
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rtts[ordered[i]] < rtts[ordered[j]]
+	})
+	result := make([]ServerAddress, len(servers))
+	for i, index := range ordered {
+		result[i] = servers[index]
+		log.Debugf("Server %s measured RTT: %s", servers[index], rtts[index])
+	}
+	return result
+}
+
+// measure probes the servers at once. Unreachable servers take longer than the probe timeout, in their order.
+func (s *serverSelector) measure(servers []ServerAddress) []time.Duration {
+	rtts := make([]time.Duration, len(servers))
+	wg := sync.WaitGroup{}
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server ServerAddress) {
+			defer wg.Done()
+			rtt, err := s.probe(server)
+			if err != nil {
+				log.Debugf("Server %s did not answer the probe. Cause: %s", server, err)
+				rtt = probeTimeout + time.Duration(i)
+			}
+			rtts[i] = rtt
+		}(i, server)
+	}
+	wg.Wait()
+	return rtts
+}
+
+// probe measures how long establishing a control connection with a server takes. The connection is closed before the
+// agent says hello, which the server takes for a probe rather than an agent.
+func (s *serverSelector) probe(server ServerAddress) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	started := time.Now()
+	conn, err := s.connect(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(started), nil
+}
+
+// ConnectServer tries the candidate servers in order and returns the control connection of the first reachable one.
+func ConnectServer(selector ServerSelector, connect func(server ServerAddress) (net.Conn, error)) (net.Conn, ServerAddress, error) {
+	candidates, err := selector.Candidates()
+	if err != nil {
+		return nil, ServerAddress{}, err
+	}
+	for _, server := range candidates {
+		conn, err := connect(server)
+		if err == nil {
+			selector.Connected(server)
+			return conn, server, nil
+		}
+		log.Errorf("Could not connect to the server at: %s Cause: %s", server.Control, err)
+	}
+	return nil, ServerAddress{}, errors.New("all servers are unreachable")
+}
+
+// FailBack disconnects the agent once a server preferred over current is reachable, so it reconnects there.
+func FailBack(selector ServerSelector, current ServerAddress, a Agent, interval time.Duration, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if preferred, ok := selector.Preferred(current); ok {
+			log.Warningf("Preferred server at: %s is reachable again. Moving back to it from: %s", preferred.Control, current.Control)
+			a.Disconnect()
+			return
+		}
+	}
+}
+
+// ParseServerList pairs a comma separated list of control connection addresses with the transfer connection
+// addresses: either a list of the same length, or a single address that all servers share. A single address without
+// a host (e.g. ":8888") stands for the port on the host of each control connection address.
+func ParseServerList(controlAddresses string, transferAddresses string) ([]ServerAddress, error) {
+	controls := splitList(controlAddresses)
+	if len(controls) == 0 {
+		return nil, errors.New("no control connection address given")
+	}
+	transfers := splitList(transferAddresses)
+	servers := make([]ServerAddress, len(controls))
+	for i, control := range controls {
+		switch {
+		case len(transfers) == len(controls):
+			servers[i] = ServerAddress{Control: control, Transfer: transfers[i]}
+		case len(transfers) == 1:
+			transfer, err := transferFor(control, transfers[0])
+			if err != nil {
+				return nil, err
+			}
+			servers[i] = ServerAddress{Control: control, Transfer: transfer}
+		default:
+			return nil, fmt.Errorf("%d transfer connection addresses given for %d servers", len(transfers), len(controls))
+		}
+	}
+	return servers, nil
+}
+
+// ResolveSRV looks up the servers of a DNS SRV name (e.g. _proxy._tcp.example.com) in priority and weight order.
+// Their transfer connection addresses are derived like in ParseServerList.
+func ResolveSRV(name string, transferAddress string) ([]ServerAddress, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var servers []ServerAddress
+	for _, record := range records {
+		control := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		transfer, err := transferFor(control, transferAddress)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, ServerAddress{Control: control, Transfer: transfer})
+	}
+	return servers, nil
+}
+
+func transferFor(control string, transfer string) (string, error) {
+	host, port, err := net.SplitHostPort(transfer)
+	if err != nil {
+		return "", fmt.Errorf("invalid transfer connection address %s: %s", transfer, err)
+	}
+	if host != "" {
+		return transfer, nil
+	}
+	controlHost, _, err := net.SplitHostPort(control)
+	if err != nil {
+		return "", fmt.Errorf("invalid control connection address %s: %s", control, err)
+	}
+	return net.JoinHostPort(controlHost, port), nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
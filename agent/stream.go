@@ -0,0 +1,313 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"project-proxy/metrics"
+)
+
+// Default limits of the bytes queued for the local connections of forwarded streams.
+const (
+	DefaultStreamQueueBytes      = 4 << 20
+	DefaultStreamQueueTotalBytes = 64 << 20
+)
+
+const (
+	// maxQueuedPayloads bounds the number of payloads queued for one stream, however small they are.
+	maxQueuedPayloads = 1024
+	// endedStreamRetention is how long a stream the agent ended stays known, so that payloads the server sent before
+	// learning about it are dropped rather than opening a new local connection.
+	endedStreamRetention = 30 * time.Second
+	// streamDrainTimeout bounds how long a stream the server closed may take to write out its queued payloads.
+	streamDrainTimeout = 30 * time.Second
+)
+
+var (
+	errStreamQueueFull = errors.New("the queue of the stream is full")
+	errAgentQueueFull  = errors.New("the queues of all streams together are full")
+	errStreamClosed    = errors.New("the stream is closed")
+)
+
+// stream is a local connection forwarded over the control connection. The payloads received for it are queued and
+// written by the stream's own goroutine, so a slow local target holds up its own stream only, never the control
+// connection. A stream whose queue overflows is shed; a stream the server closes writes out its queue first.
+type stream struct {
+	conn       net.Conn
+	payloads   chan []byte
+	queued     int64
+	budget     *streamBudget
+	closed     chan struct{}
+	isClosed   bool
+	drain      chan struct{}
+	isDraining bool
+	mutex      sync.Mutex
+}
+
+// streamBudget caps the bytes queued for a single stream and for all streams of an agent together.
+type streamBudget struct {
+	streamBytes int64
+	totalBytes  int64
+	queued      int64
+}
+
+func newStream(budget *streamBudget) *stream {
+	return &stream{
+		payloads: make(chan []byte, maxQueuedPayloads),
+		budget:   budget,
+		closed:   make(chan struct{}),
+		drain:    make(chan struct{}),
+	}
+}
+
+// push queues a payload without ever blocking. A payload is always accepted into an empty stream queue, so payloads
+// larger than the stream budget still get through one at a time.
+func (s *stream) push(payload []byte) error {
+	n := int64(len(payload))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed || s.isDraining {
+		return errStreamClosed
+	}
+	if s.queued > 0 && s.queued+n > s.budget.streamBytes {
+		return errStreamQueueFull
+	}
+	if atomic.AddInt64(&s.budget.queued, n) > s.budget.totalBytes && s.queued > 0 {
+		atomic.AddInt64(&s.budget.queued, -n)
+		return errAgentQueueFull
+	}
+	select {
+	case s.payloads <- payload:
+		s.queued += n
+		return nil
+	default:
+		atomic.AddInt64(&s.budget.queued, -n)
+		return errStreamQueueFull
+	}
+}
+
+// next returns the next queued payload, or false once the stream is closed or drained.
+func (s *stream) next() ([]byte, bool) {
+	select {
+	case payload := <-s.payloads:
+		return payload, true
+	case <-s.closed:
+		return nil, false
+	case <-s.drain:
+		select {
+		case payload := <-s.payloads:
+			return payload, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// finish lets the stream write out the payloads queued so far and close afterwards, as no more will arrive. Writing
+// them out may take streamDrainTimeout at most.
+func (s *stream) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed || s.isDraining {
+		return
+	}
+	s.isDraining = true
+	close(s.drain)
+	time.AfterFunc(streamDrainTimeout, func() {
+		s.close()
+	})
+}
+
+func (s *stream) draining() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.isDraining
+}
+
+// written releases the budget taken by a payload once it has been written.
+func (s *stream) written(payload []byte) {
+	n := int64(len(payload))
+	s.mutex.Lock()
+	s.queued -= n
+	s.mutex.Unlock()
+	atomic.AddInt64(&s.budget.queued, -n)
+}
+
+// setConn hands the local connection to the stream. It returns false if the stream was closed while connecting.
+func (s *stream) setConn(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed {
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
+// close closes the local connection, if any, and drops the queued payloads. It returns false if the stream was
+// closed already.
+func (s *stream) close() (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed {
+		return false, nil
+	}
+	s.isClosed = true
+	close(s.closed)
+drain:
+	for {
+		select {
+		case payload := <-s.payloads:
+			atomic.AddInt64(&s.budget.queued, -int64(len(payload)))
+		default:
+			break drain
+		}
+	}
+	s.queued = 0
+	if s.conn == nil {
+		return true, nil
+	}
+	return true, s.conn.Close()
+}
+
+// SetStreamQueueLimits sets how many bytes may be queued for the local connection of a single forwarded stream and
+// for all of them together before a stream is shed.
+func (a *agent) SetStreamQueueLimits(streamBytes int64, totalBytes int64) {
+	a.streamBudget.streamBytes = streamBytes
+	a.streamBudget.totalBytes = totalBytes
+}
+
+func (a *agent) getStream(id uint32) *stream {
+	a.streamsMutex.Lock()
+	defer a.streamsMutex.Unlock()
+	return a.streams[id]
+}
+
+func (a *agent) addStream(id uint32) *stream {
+	s := newStream(&a.streamBudget)
+	a.streamsMutex.Lock()
+	defer a.streamsMutex.Unlock()
+	a.streams[id] = s
+	return s
+}
+
+// removeStream forgets a stream and returns it, or nil if it is unknown. A non-nil expected only removes that stream.
+func (a *agent) removeStream(id uint32, expected *stream) *stream {
+	a.streamsMutex.Lock()
+	defer a.streamsMutex.Unlock()
+	s := a.streams[id]
+	if s == nil || expected != nil && s != expected {
+		return nil
+	}
+	delete(a.streams, id)
+	return s
+}
+
+// endStream closes a stream on the agent's side and asks the server to close the remote connection, unless the
+// stream was ended already, e.g. by the server.
+func (a *agent) endStream(id uint32, s *stream) {
+	closedNow, _ := s.close()
+	if !closedNow || a.getStream(id) != s {
+		return
+	}
+	a.messenger.SendCloseConn(id)
+	time.AfterFunc(endedStreamRetention, func() {
+		a.removeStream(id, s)
+	})
+}
+
+// forward queues a payload received for a stream, opening the stream on its first payload. A stream whose queue
+// overflows is shed.
+func (a *agent) forward(id uint32, service uint32, payload []byte) {
+	clog := a.connLog(id)
+	s := a.getStream(id)
+	if s == nil {
+		clog.Infof("Connection not found. Opening new local connection")
+		s = a.addStream(id)
+		go a.runStream(id, service, s)
+	}
+	err := s.push(payload)
+	if err == errStreamClosed {
+		clog.Debugf("Dropping %d bytes for a closed local connection", len(payload))
+		return
+	}
+	if err != nil {
+		clog.Warningf("The local connection does not keep up. Closing local connection. Sending request to close remote connection. Cause: %s", err)
+		reason := "stream_queue_full"
+		if err == errAgentQueueFull {
+			reason = "agent_queue_full"
+		}
+		metrics.StreamsShedTotal.Inc(reason)
+		a.endStream(id, s)
+	}
+}
+
+// runStream opens the local connection of a stream, starts reading it and writes the queued payloads to it until the
+// stream is closed or drained.
+func (a *agent) runStream(id uint32, service uint32, s *stream) {
+	clog := a.connLog(id)
+	localConn, err := a.localConnFactory.ConnectContext(a.ctx)
+	if err != nil {
+		clog.Errorf("Error while opening new local connection. Sending request to close remote connection. Cause: %s", err)
+		a.endStream(id, s)
+		return
+	}
+	if !s.setConn(localConn) {
+		localConn.Close()
+		return
+	}
+	go a.readStream(id, service, s, localConn)
+	for {
+		payload, ok := s.next()
+		if !ok {
+			if _, err := s.close(); err != nil {
+				clog.Warningf("Closing the local connection failed. Cause: %s", err)
+			}
+			return
+		}
+		clog.Debugf("Writing bytes (total: %d) to the local connection", len(payload))
+		length, err := localConn.Write(payload)
+		s.written(payload)
+		if err != nil {
+			clog.Errorf("Error while writing to local connection. Closing local connection. Sending request to close remote connection. Cause: %s", err)
+			a.endStream(id, s)
+			return
+		} else if length == 0 {
+			clog.Warningf("Written no bytes to the local connection. This usually indicates a timeout. Closing local connection. Sending request to close remote connection")
+			a.endStream(id, s)
+			return
+		}
+		clog.Debugf("Successfully written %d of %d bytes to the local connection", length, len(payload))
+	}
+}
+
+// readStream forwards what the local connection of a stream sends to the server.
+func (a *agent) readStream(id uint32, service uint32, s *stream, localConn net.Conn) {
+	clog := a.connLog(id)
+	clog.Infof("Creating a new buffer of %d bytes for the new local connection", a.bufferSize)
+	buffer := make([]byte, a.bufferSize)
+	for {
+		len, err := localConn.Read(buffer)
+		clog.Debugf("Read %d bytes from the local connection", len)
+		if err != nil && s.draining() {
+			clog.Debugf("Stopped reading the local connection of a stream the server closed. Cause: %s", err)
+			return
+		} else if err != nil {
+			clog.Errorf("Error while reading the local connection. Closing local connection. Sending request to close remote connection. Cause: %s", err)
+			a.endStream(id, s)
+			return
+		} else if len == 0 {
+			clog.Warningf("Read no bytes from the local connection. This usually indicates a timeout. Closing local connection. Sending request to close remote connection")
+			a.endStream(id, s)
+			return
+		}
+		if s.draining() {
+			clog.Debugf("Dropping %d bytes read after the server closed the remote connection", len)
+			continue
+		}
+		clog.Debugf("Sending %d bytes to the server", len)
+		a.messenger.SendForward(id, service, buffer[:len])
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"io/ioutil"
+	"github.com/jamiealquiza/envy"
+	"project-proxy/certs"
+	"project-proxy/client"
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+	"time"
+)
+
+func main() {
+	serverConnNetworkType := flag.String("server-conn-net-type", "tcp", "The network type of the connection to the server's client-conn-addr (tcp, ws or wss)")
+	serverConnAddress := flag.String("server-conn-addr", ":9100", "The ip_addr:port combination of the server's client connections")
+	serverConnWsPath := flag.String("server-conn-ws-path", "/client", "The HTTP path of the server's client connections when using the ws or wss network type")
+	serviceName := flag.String("service-name", "default", "The name of the agent service to expose")
+	localConnNetworkType := flag.String("local-conn-net-type", "tcp", "The network type the service is exposed on (tcp, unix or unixpacket)")
+	localConnAddress := flag.String("local-conn-addr", "127.0.0.1:2222", "The ip_addr:port combination (or unix socket path) the service is exposed on")
+	useStdio := flag.Bool("stdio", false, "If true, connects stdin/stdout to the service once instead of listening, e.g. for use as an SSH ProxyCommand")
+	certFile := flag.String("tls-cert-file", "", "PEM file with the client certificate, signed by the root certificate. Empty uses the built-in agent certificate")
+	keyFile := flag.String("tls-key-file", "", "PEM file with the private key of the client certificate")
+	egressProxy := flag.String("egress-proxy", "", "URL of an HTTP CONNECT or SOCKS5 proxy for the server connections. Empty uses HTTPS_PROXY or ALL_PROXY, 'direct' disables proxying")
+	dialTimeout := flag.Int("dial-timeout", 30000, "Max time in ms to establish the connection to the server before the attempt is given up. Setting this to zero disables the timeout")
+	handshakeTimeout := flag.Int("handshake-timeout", 10000, "Max time in ms for the TLS and WebSocket handshakes with the server. Setting this to zero disables the timeout")
+	logLevel := flag.Int("log-level", 4, "Log levels: 0 CRITICAL, 1 ERROR, 2 WARNING, 3 NOTICE, 4 INFO, 5 DEBUG")
+	logModuleLevels := flag.String("log-module-levels", "", "Comma separated module=level pairs overriding log-level for single modules, e.g. server=5,proxy=2. Modules: main, server, agent, client, mess, mess_ovr, proxy, admin, logs. On unix SIGUSR1 makes the default level more verbose and SIGUSR2 restores the startup levels")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logSink := flag.String("log-sink", "stderr", "Where the logs are written: stdout, stderr, file, syslog or journald")
+	logFile := flag.String("log-file", "", "Path of the log file used by the file log sink")
+	logFileMaxSize := flag.Int("log-file-max-size", 100, "Size in MB after which the log file is rotated. Setting this to zero disables rotation")
+	logFileMaxBackups := flag.Int("log-file-max-backups", 5, "Number of rotated log files kept")
+
+	envy.Parse("APP")
+	flag.Parse()
+
+	err := logs.InitWithOptions(logs.Options{
+		Level:          *logLevel,
+		ModuleLevels:   *logModuleLevels,
+		Format:         *logFormat,
+		Sink:           *logSink,
+		File:           *logFile,
+		FileMaxSizeMB:  *logFileMaxSize,
+		FileMaxBackups: *logFileMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up logging. Cause: %s\n", err)
+		os.Exit(1)
+	}
+	connOptions := connectivity.ConnOptions{
+		DialTimeout:      time.Duration(*dialTimeout) * time.Millisecond,
+		HandshakeTimeout: time.Duration(*handshakeTimeout) * time.Millisecond,
+	}
+	logs.HandleLevelSignals()
+	log := logs.GetLoggerForModule("main")
+
+	cert, key := certs.AgentCertificate, certs.AgentPrivateKey
+	if *certFile != "" {
+		certBytes, err := ioutil.ReadFile(*certFile)
+		if err != nil {
+			log.Fatalf("Could not read the client certificate. Cause: %s", err)
+		}
+		keyBytes, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			log.Fatalf("Could not read the client private key. Cause: %s", err)
+		}
+		cert, key = string(certBytes), string(keyBytes)
+	} else {
+		log.Warning("No client certificate is set. Using the built-in agent certificate")
+	}
+	tlsConfig := connectivity.NewTLSConfig(certs.RootCertificate, key, cert, false)
+	serverCf := connectivity.NewTunnelConnectionFactory(tlsConfig, false, *serverConnNetworkType, *serverConnAddress, *serverConnWsPath)
+	serverCf.SetOptions(connOptions)
+
+	proxyURL, noProxy := connectivity.EgressProxyFromEnvironment()
+	if *egressProxy != "" {
+		proxyURL = *egressProxy
+	}
+	if proxyURL != "" && proxyURL != "direct" {
+		dialer, err := connectivity.NewEgressProxyDialer(proxyURL, noProxy, connOptions)
+		if err != nil {
+			log.Fatalf("Could not configure the egress proxy. Cause: %s", err)
+		}
+		serverCf.SetDialer(dialer)
+	}
+
+	c := client.NewClient(serverCf, *serviceName)
+	if *useStdio {
+		err := c.ServeConn(connectivity.NewStdioConn())
+		if err != nil {
+			log.Fatalf("Could not connect to service: %s Cause: %s", *serviceName, err)
+		}
+		return
+	}
+
+	var localCf connectivity.ConnFactory
+	if connectivity.IsUnixNetworkType(*localConnNetworkType) {
+		localCf = connectivity.NewUnixConnectionFactory(*localConnNetworkType, *localConnAddress, "", 0)
+	} else {
+		localCf = connectivity.NewTCPConnectionFactory(*localConnNetworkType, *localConnAddress)
+	}
+	localCf.SetOptions(connOptions)
+	err = c.Serve(localCf)
+	if err != nil {
+		log.Fatalf("Could not expose service: %s Cause: %s", *serviceName, err)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+)
+
+type client struct {
+	serverConnFactory connectivity.ConnFactory
+	serviceName       string
+}
+
+type Client interface {
+	Connect() (net.Conn, error)
+	Serve(localConnFactory connectivity.ConnFactory) error
+	ServeConn(localConn net.Conn) error
+}
+
+var log = logs.GetLoggerForModule("client")
+
+func NewClient(serverConnFactory connectivity.ConnFactory, serviceName string) Client {
+	return &client{
+		serverConnFactory: serverConnFactory,
+		serviceName:       serviceName,
+	}
+}
+
+// Connect opens a connection to the server and requests the service. The returned connection carries the service's bytes.
+func (c *client) Connect() (net.Conn, error) {
+	conn, err := c.serverConnFactory.Connect()
+	if err != nil {
+		return nil, err
+	}
+	err = connectivity.WriteServiceRequest(conn, c.serviceName)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	status, err := connectivity.ReadServiceResponse(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch status {
+	case connectivity.ServiceAccepted:
+		return conn, nil
+	case connectivity.ServiceUnknown:
+		conn.Close()
+		return nil, fmt.Errorf("the server does not know service: %s", c.serviceName)
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("service: %s is currently unavailable", c.serviceName)
+	}
+}
+
+// Serve exposes the service on the local listener, opening one server connection per accepted local connection.
+func (c *client) Serve(localConnFactory connectivity.ConnFactory) error {
+	ln, err := localConnFactory.Listen()
+	if err != nil {
+		return err
+	}
+	log.Infof("Exposing service: %s at %s", c.serviceName, connectivity.DescribeAddress(localConnFactory.GetNetworkType(), localConnFactory.GetAddress()))
+	for {
+		localConn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := c.ServeConn(localConn)
+			if err != nil {
+				log.With(logs.FieldClientAddress, localConn.RemoteAddr(), logs.FieldService, c.serviceName).Errorf("Could not connect local connection to service: %s Closing local connection. Cause: %s", c.serviceName, err)
+			}
+		}()
+	}
+}
+
+// ServeConn connects a single local connection (e.g. stdio) to the service and blocks until either side closes it.
+func (c *client) ServeConn(localConn net.Conn) error {
+	serverConn, err := c.Connect()
+	if err != nil {
+		localConn.Close()
+		return err
+	}
+	clog := log.With(logs.FieldClientAddress, localConn.RemoteAddr(), logs.FieldService, c.serviceName)
+	clog.Infof("Connected to service: %s", c.serviceName)
+	p := connectivity.NewConnProxy(localConn, serverConn)
+	p.SetLogFields(clog.Fields()...)
+	p.Run()
+	return nil
+}
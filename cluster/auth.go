@@ -0,0 +1,159 @@
+package cluster
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Credentials are what a node proves it belongs to the cluster with: its own certificate and the CA that signed the
+// certificates of all nodes. The CA must not be the one of agents and clients, whose certificates ship with every
+// agent binary.
+type Credentials struct {
+	Certificate tls.Certificate
+	Roots       *x509.CertPool
+}
+
+var errNotNamed = errors.New("the certificate does not name the node")
+
+// LoadCredentials reads the PEM files of the certificate and key of a node and of the cluster CA.
+func LoadCredentials(certFile string, keyFile string, caFile string) (Credentials, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return Credentials{}, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return Credentials{Certificate: certificate, Roots: roots}, nil
+}
+
+// tlsConfig returns the config of the connections between nodes: both sides present a certificate signed by the
+// cluster CA. The address a node is reached at need not be in its certificate; who a relayed connection reaches is
+// checked against the name of the member instead.
+func (c Credentials) tlsConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{c.Certificate},
+		ClientCAs:          c.Roots,
+		ClientAuth:         tls.RequireAndVerifyClientCert,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate presented")
+			}
+			_, err := c.verify(rawCerts[0])
+			return err
+		},
+	}
+}
+
+// verify parses a certificate and checks that the cluster CA signed it.
+func (c Credentials) verify(der []byte) (*x509.Certificate, error) {
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	_, err = certificate.Verify(x509.VerifyOptions{Roots: c.Roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+// Trusts tells if the cluster CA signed the PEM certificate, e.g. to make sure agent certificates do not belong to
+// the cluster.
+func (c Credentials) Trusts(certificatePEM string) bool {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return false
+	}
+	_, err := c.verify(block.Bytes)
+	return err == nil
+}
+
+// names tells if a certificate belongs to the node with the given name, in its common name or as a DNS name.
+func names(certificate *x509.Certificate, name string) bool {
+	if certificate.Subject.CommonName == name {
+		return true
+	}
+	for _, dnsName := range certificate.DNSNames {
+		if dnsName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// peerNames tells if the other side of a TLS connection presented the certificate of the named node.
+func peerNames(conn net.Conn, name string) bool {
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return false
+	}
+	peers := tlsConn.ConnectionState().PeerCertificates
+	return len(peers) > 0 && names(peers[0], name)
+}
+
+// signedPart is what the signature of an entry covers. LastSeen and Alive are what the receiving node makes of it.
+func (m *Member) signedPart() []byte {
+	data, _ := json.Marshal(struct {
+		Name    string
+		Address string
+		Seq     uint64
+		Agents  []MemberAgent
+	}{m.Name, m.Address, m.Seq, m.Agents})
+	return data
+}
+
+// sign signs the entry of this node with the key of its certificate, which it carries along.
+func (c Credentials) sign(m *Member) error {
+	key, ok := c.Certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("the key of the node cannot sign")
+	}
+	var err error
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		m.Signature, err = key.Sign(rand.Reader, m.signedPart(), crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(m.signedPart())
+		m.Signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	m.Certificate = c.Certificate.Certificate[0]
+	return err
+}
+
+// verifyMember checks that the node an entry is about signed it, so no node can change what the others know about
+// another one.
+func (c Credentials) verifyMember(m *Member) error {
+	certificate, err := c.verify(m.Certificate)
+	if err != nil {
+		return err
+	}
+	if !names(certificate, m.Name) {
+		return errNotNamed
+	}
+	var algorithm x509.SignatureAlgorithm
+	switch certificate.PublicKeyAlgorithm {
+	case x509.RSA:
+		algorithm = x509.SHA256WithRSA
+	case x509.ECDSA:
+		algorithm = x509.ECDSAWithSHA256
+	case x509.Ed25519:
+		algorithm = x509.PureEd25519
+	}
+	return certificate.CheckSignature(algorithm, m.signedPart(), m.Signature)
+}
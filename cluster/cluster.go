@@ -0,0 +1,377 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+	"project-proxy/server"
+)
+
+var log = logs.GetLoggerForModule("cluster")
+
+// Every connection between nodes starts with one byte telling what it is for.
+const (
+	frameGossip byte = 'G'
+	frameRelay  byte = 'R'
+)
+
+const (
+	gossipTimeout = 5 * time.Second
+	// gossipFanout is the number of nodes every node exchanges its view with per gossip round.
+	gossipFanout = 3
+)
+
+// Member is what a node of the cluster knows about another node (or itself): where it is reachable and which agents
+// hold their control sessions with it. Seq grows with every update the node makes about itself. The node signs its
+// entry with the key of Certificate.
+type Member struct {
+	Name        string        `json:"name"`
+	Address     string        `json:"address"`
+	Seq         uint64        `json:"seq"`
+	Agents      []MemberAgent `json:"agents"`
+	Alive       bool          `json:"alive"`
+	LastSeen    time.Time     `json:"lastSeen"`
+	Certificate []byte        `json:"certificate"`
+	Signature   []byte        `json:"signature"`
+}
+
+type MemberAgent struct {
+	Name    string `json:"name"`
+	Service string `json:"service"`
+}
+
+// Node is one server of a cluster. Nodes gossip their agents with each other, so a connection for a service no local
+// agent serves can be relayed to a node whose agent does.
+type Node interface {
+	// SetListenAddress sets the address the node listens at when it differs from the one other nodes reach it at,
+	// e.g. behind NAT.
+	SetListenAddress(address string)
+	// Start listens for other nodes and starts gossiping with the seed nodes, until ctx is done.
+	Start(ctx context.Context) error
+	// GetMembers returns the nodes this one knows, itself included.
+	GetMembers() []Member
+	server.Relay
+}
+
+type node struct {
+	name          string
+	address       string
+	listenAddress string
+	seeds         []string
+	interval      time.Duration
+	deadAfter     time.Duration
+	credentials   Credentials
+	options       connectivity.ConnOptions
+	registry      server.Registry
+	hub           server.Hub
+	members       map[string]*Member
+	seq           uint64
+	membersMutex  sync.Mutex
+	random        *rand.Rand
+	randomMutex   sync.Mutex
+}
+
+// NewNode creates the node named name listening at address, which other nodes reach it at. An empty name is taken
+// from the common name of the node's certificate, which must name the node either way. seeds are addresses of other
+// nodes to start gossiping with; the rest of the cluster is learnt from them. Nodes only talk TLS with each other,
+// authenticated with credentials, and connect with options. A node that has not been heard of for deadAfter is
+// considered down.
+func NewNode(name string, address string, seeds []string, interval time.Duration, deadAfter time.Duration,
+	credentials Credentials, options connectivity.ConnOptions, registry server.Registry, hub server.Hub) Node {
+	if name == "" && len(credentials.Certificate.Certificate) > 0 {
+		if certificate, err := x509.ParseCertificate(credentials.Certificate.Certificate[0]); err == nil {
+			name = certificate.Subject.CommonName
+		}
+	}
+	return &node{
+		name:        name,
+		address:     address,
+		seeds:       seeds,
+		interval:    interval,
+		deadAfter:   deadAfter,
+		credentials: credentials,
+		options:     options,
+		registry:    registry,
+		hub:         hub,
+		members:     make(map[string]*Member),
+		seq:         uint64(time.Now().UnixNano()),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// factory returns the factory of the connections to and from the node at address.
+func (n *node) factory(address string) connectivity.ConnFactory {
+	factory := connectivity.NewTLSConnectionFactoryWithConfig(n.credentials.tlsConfig(), "tcp", address)
+	factory.SetOptions(n.options)
+	return factory
+}
+
+func (n *node) SetListenAddress(address string) {
+	n.listenAddress = address
+}
+
+func (n *node) Start(ctx context.Context) error {
+	if len(n.credentials.Certificate.Certificate) == 0 {
+		return errors.New("the node has no certificate")
+	}
+	certificate, err := n.credentials.verify(n.credentials.Certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("the certificate of the node is not signed by the cluster CA: %s", err)
+	}
+	if !names(certificate, n.name) {
+		return fmt.Errorf("%s: %q", errNotNamed, n.name)
+	}
+	address := n.listenAddress
+	if address == "" {
+		address = n.address
+	}
+	ln, err := n.factory(address).ListenContext(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Cluster node: %s listening at %s", n.name, address)
+	n.updateSelf()
+	go n.accept(ln)
+	go func() {
+		for {
+			n.updateSelf()
+			n.gossipRound()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(n.interval):
+			}
+		}
+	}()
+	return nil
+}
+
+func (n *node) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Errorf("Error while accepting a cluster connection. No more cluster connections will be accepted. Cause: %s", err)
+			return
+		}
+		go n.handleConn(conn)
+	}
+}
+
+func (n *node) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(gossipTimeout))
+	frame := make([]byte, 1)
+	_, err := conn.Read(frame)
+	if err != nil {
+		log.With(logs.FieldPeerAddress, conn.RemoteAddr()).Warningf("Could not read a cluster connection. Closing it. Cause: %s", err)
+		conn.Close()
+		return
+	}
+	switch frame[0] {
+	case frameGossip:
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var members []Member
+		err = json.NewDecoder(reader).Decode(&members)
+		if err != nil {
+			log.With(logs.FieldPeerAddress, conn.RemoteAddr()).Warningf("Could not read the gossip of a node. Cause: %s", err)
+			return
+		}
+		n.merge(members)
+		err = json.NewEncoder(conn).Encode(n.snapshot())
+		if err != nil {
+			log.With(logs.FieldPeerAddress, conn.RemoteAddr()).Warningf("Could not answer the gossip of a node. Cause: %s", err)
+		}
+	case frameRelay:
+		conn.SetDeadline(time.Time{})
+		n.hub.ServeRelayed(conn)
+	default:
+		log.With(logs.FieldPeerAddress, conn.RemoteAddr()).Warningf("Unknown cluster connection type: %d Closing it", frame[0])
+		conn.Close()
+	}
+}
+
+// updateSelf refreshes this node's own entry from the agents connected to it, leaving out those whose local target
+// is unhealthy. The sequence number starts from the clock, so the other nodes take a restarted node's entry over the
+// stale one they keep.
+func (n *node) updateSelf() {
+	var agents []MemberAgent
+	for _, s := range n.registry.GetServers() {
+		if !s.IsListening() {
+			continue
+		}
+		info := s.GetAgentInfo()
+		if info.Health == server.TargetHealthUnhealthy {
+			continue
+		}
+		agents = append(agents, MemberAgent{Name: info.Name, Service: info.Service})
+	}
+	n.membersMutex.Lock()
+	defer n.membersMutex.Unlock()
+	n.seq++
+	self := &Member{
+		Name:     n.name,
+		Address:  n.address,
+		Seq:      n.seq,
+		Agents:   agents,
+		LastSeen: time.Now(),
+	}
+	if err := n.credentials.sign(self); err != nil {
+		log.Errorf("Could not sign the entry of this node. The other nodes will ignore it. Cause: %s", err)
+	}
+	n.members[n.name] = self
+}
+
+// gossipRound exchanges this node's view with a few random known nodes and with the seeds not known by name yet.
+func (n *node) gossipRound() {
+	targets := make(map[string]bool)
+	n.membersMutex.Lock()
+	known := make(map[string]bool)
+	var addresses []string
+	for name, m := range n.members {
+		known[m.Address] = true
+		if name != n.name {
+			addresses = append(addresses, m.Address)
+		}
+	}
+	n.membersMutex.Unlock()
+	for _, seed := range n.seeds {
+		if !known[seed] {
+			targets[seed] = true
+		}
+	}
+	n.randomMutex.Lock()
+	n.random.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	n.randomMutex.Unlock()
+	for i := 0; i < len(addresses) && i < gossipFanout; i++ {
+		targets[addresses[i]] = true
+	}
+	for address := range targets {
+		go func(address string) {
+			err := n.gossip(address)
+			if err != nil {
+				log.Debugf("Could not gossip with the node at %s. Cause: %s", address, err)
+			}
+		}(address)
+	}
+	n.expire()
+}
+
+func (n *node) gossip(address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gossipTimeout)
+	defer cancel()
+	conn, err := n.factory(address).ConnectContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gossipTimeout))
+	_, err = conn.Write([]byte{frameGossip})
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(conn).Encode(n.snapshot())
+	if err != nil {
+		return err
+	}
+	var members []Member
+	err = json.NewDecoder(bufio.NewReader(conn)).Decode(&members)
+	if err != nil {
+		return err
+	}
+	n.merge(members)
+	return nil
+}
+
+// merge keeps the newest entry of every node, provided that node signed it.
+func (n *node) merge(members []Member) {
+	n.membersMutex.Lock()
+	defer n.membersMutex.Unlock()
+	for _, m := range members {
+		if m.Name == n.name {
+			continue
+		}
+		known := n.members[m.Name]
+		if known != nil && known.Seq >= m.Seq {
+			continue
+		}
+		if err := n.credentials.verifyMember(&m); err != nil {
+			log.Warningf("Ignoring an entry for cluster node: %s that it did not sign. Cause: %s", m.Name, err)
+			continue
+		}
+		if known == nil {
+			log.Infof("Cluster node: %s at %s joined", m.Name, m.Address)
+		}
+		m := m
+		m.LastSeen = time.Now()
+		n.members[m.Name] = &m
+	}
+}
+
+// expire forgets nodes that have been down for long.
+func (n *node) expire() {
+	n.membersMutex.Lock()
+	defer n.membersMutex.Unlock()
+	for name, m := range n.members {
+		if name != n.name && time.Since(m.LastSeen) > 2*n.deadAfter {
+			log.Warningf("Cluster node: %s at %s has not been heard of since %s. Forgetting it", name, m.Address,
+				m.LastSeen.Format(time.RFC3339))
+			delete(n.members, name)
+		}
+	}
+}
+
+func (n *node) snapshot() []Member {
+	n.membersMutex.Lock()
+	defer n.membersMutex.Unlock()
+	members := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		members = append(members, *m)
+	}
+	return members
+}
+
+func (n *node) GetMembers() []Member {
+	members := n.snapshot()
+	for i := range members {
+		members[i].Alive = members[i].Name == n.name || time.Since(members[i].LastSeen) <= n.deadAfter
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+// serving returns the other live nodes with an agent for the service (any agent if the service is empty), in random
+// order.
+func (n *node) serving(serviceName string) []Member {
+	var members []Member
+	for _, m := range n.GetMembers() {
+		if m.Name == n.name || !m.Alive {
+			continue
+		}
+		for _, a := range m.Agents {
+			if serviceName == "" || a.Service == serviceName {
+				members = append(members, m)
+				break
+			}
+		}
+	}
+	n.randomMutex.Lock()
+	n.random.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
+	})
+	n.randomMutex.Unlock()
+	return members
+}
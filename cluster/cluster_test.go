@@ -0,0 +1,264 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/server"
+)
+
+func newTestNode(t *testing.T, ca *testCA, name string) *node {
+	return NewNode(name, "127.0.0.1:0", nil, time.Second, time.Second, ca.credentials(t, name),
+		connectivity.DefaultConnOptions(), server.NewRegistry(), nil).(*node)
+}
+
+// signed returns the entry as the node with credentials signs it.
+func signed(t *testing.T, credentials Credentials, m Member) Member {
+	t.Helper()
+	if err := credentials.sign(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMergeKeepsNewestSeq(t *testing.T) {
+	ca := newTestCA(t)
+	n := newTestNode(t, ca, "a")
+	b := ca.credentials(t, "b")
+	n.merge([]Member{signed(t, b, Member{Name: "b", Address: "b:1", Seq: 5, Agents: []MemberAgent{{Name: "x", Service: "ssh"}}})})
+	n.merge([]Member{signed(t, b, Member{Name: "b", Address: "b:1", Seq: 3})})
+	if got := n.members["b"]; got.Seq != 5 || len(got.Agents) != 1 {
+		t.Fatalf("An older entry replaced a newer one: %+v", got)
+	}
+	n.merge([]Member{signed(t, b, Member{Name: "b", Address: "b:2", Seq: 5})})
+	if got := n.members["b"]; got.Address != "b:1" {
+		t.Fatalf("An entry with the same seq replaced the known one: %+v", got)
+	}
+	n.merge([]Member{signed(t, b, Member{Name: "b", Address: "b:2", Seq: 7})})
+	if got := n.members["b"]; got.Seq != 7 || got.Address != "b:2" || len(got.Agents) != 0 {
+		t.Fatalf("A newer entry was not taken: %+v", got)
+	}
+}
+
+func TestMergeIgnoresOwnEntry(t *testing.T) {
+	ca := newTestCA(t)
+	n := newTestNode(t, ca, "a")
+	n.updateSelf()
+	seq := n.members["a"].Seq
+	n.merge([]Member{signed(t, n.credentials, Member{Name: "a", Address: "elsewhere:1", Seq: seq + 100})})
+	if got := n.members["a"]; got.Seq != seq || got.Address != n.address {
+		t.Fatalf("Another node's view replaced the node's own entry: %+v", got)
+	}
+}
+
+func TestMergeRejectsEntriesNotSignedByTheirNode(t *testing.T) {
+	ca := newTestCA(t)
+	n := newTestNode(t, ca, "a")
+	b := ca.credentials(t, "b")
+	n.merge([]Member{signed(t, b, Member{Name: "b", Address: "b:1", Seq: 1})})
+	tampered := signed(t, b, Member{Name: "b", Address: "b:1", Seq: 2})
+	tampered.Address = "attacker:1"
+	tests := []struct {
+		name  string
+		entry Member
+	}{
+		{"signed by another node", signed(t, ca.credentials(t, "c"), Member{Name: "b", Address: "attacker:1", Seq: 2})},
+		{"changed after signing", tampered},
+		{"signed outside the cluster", signed(t, newTestCA(t).credentials(t, "b"), Member{Name: "b", Address: "attacker:1", Seq: 2})},
+		{"unsigned", Member{Name: "b", Address: "attacker:1", Seq: 2}},
+	}
+	for _, test := range tests {
+		n.merge([]Member{test.entry})
+		if got := n.members["b"]; got.Address != "b:1" || got.Seq != 1 {
+			t.Fatalf("An entry %s was taken: %+v", test.name, got)
+		}
+	}
+}
+
+func TestMergeStampsLastSeen(t *testing.T) {
+	ca := newTestCA(t)
+	n := newTestNode(t, ca, "a")
+	n.merge([]Member{signed(t, ca.credentials(t, "b"), Member{Name: "b", Seq: 1, LastSeen: time.Now().Add(-time.Hour)})})
+	if time.Since(n.members["b"].LastSeen) > time.Minute {
+		t.Fatalf("The sender's last seen time was kept: %s", n.members["b"].LastSeen)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ca := newTestCA(t)
+	n := newTestNode(t, ca, "a")
+	n.updateSelf()
+	for _, name := range []string{"fresh", "down", "gone"} {
+		n.merge([]Member{signed(t, ca.credentials(t, name), Member{Name: name, Seq: 1})})
+	}
+	n.members["down"].LastSeen = time.Now().Add(-3 * n.deadAfter / 2)
+	n.members["gone"].LastSeen = time.Now().Add(-3 * n.deadAfter)
+	n.members["a"].LastSeen = time.Now().Add(-3 * n.deadAfter)
+	n.expire()
+	alive := make(map[string]bool)
+	for _, m := range n.GetMembers() {
+		alive[m.Name] = m.Alive
+	}
+	if len(alive) != 3 || !alive["a"] || !alive["fresh"] || alive["down"] {
+		t.Fatalf("Unexpected members after expiry: %v", alive)
+	}
+	if _, ok := alive["gone"]; ok {
+		t.Fatalf("A node not heard of for twice the dead time was kept")
+	}
+}
+
+func TestStartRequiresCertificateNamingTheNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ca := newTestCA(t)
+	n := NewNode("a", freeAddress(t), nil, time.Second, time.Second, ca.credentials(t, "b"),
+		connectivity.DefaultConnOptions(), server.NewRegistry(), nil)
+	if err := n.Start(ctx); err == nil {
+		t.Fatalf("A node started with the certificate of another node")
+	}
+	n = NewNode("", freeAddress(t), nil, time.Second, time.Second, ca.credentials(t, "b"),
+		connectivity.DefaultConnOptions(), server.NewRegistry(), nil)
+	if err := n.Start(ctx); err != nil {
+		t.Fatalf("A node without a name did not take the one of its certificate: %s", err)
+	}
+}
+
+func TestGossipSpreadsAgents(t *testing.T) {
+	nodes := startCluster(t, newTestCA(t), 3)
+	nodes[2].startAgent(t, "agent", "ssh", startTarget(t, "hello"))
+	for _, tn := range nodes {
+		tn := tn
+		eventually(t, "all nodes know each other", func() bool {
+			return len(tn.GetMembers()) == len(nodes)
+		})
+	}
+	eventually(t, "the first node learns the agent of the last one", func() bool {
+		return nodes[0].knows("ssh")
+	})
+	if nodes[2].knows("ssh") {
+		t.Fatalf("A node lists itself as another node serving its own agent's service")
+	}
+}
+
+// requestService asks for the service over conn, after sending frame if it is not 0, and returns the status and what
+// the service sends.
+func requestService(t *testing.T, conn net.Conn, frame byte, serviceName string) (byte, string) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if frame != 0 {
+		if _, err := conn.Write([]byte{frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := connectivity.WriteServiceRequest(conn, serviceName); err != nil {
+		t.Fatal(err)
+	}
+	status, err := connectivity.ReadServiceResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != connectivity.ServiceAccepted {
+		return status, ""
+	}
+	greeting, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(greeting)
+}
+
+func dial(t *testing.T, address string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestRelayFrameServesLocalAgentsOnly(t *testing.T) {
+	ca := newTestCA(t)
+	nodes := startCluster(t, ca, 2)
+	nodes[0].startAgent(t, "agent", "ssh", startTarget(t, "hello"))
+	eventually(t, "the second node learns the agent", func() bool {
+		return nodes[1].knows("ssh")
+	})
+	peer := ca.credentials(t, "peer")
+	conn, err := dialNode(t, nodes[0].address, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, greeting := requestService(t, conn, frameRelay, "ssh")
+	if status != connectivity.ServiceAccepted || greeting != "hello" {
+		t.Fatalf("Relay frame to the agent's node: status %d, greeting %q", status, greeting)
+	}
+	// The second node only knows the service through gossip, so it must not relay a relayed connection on.
+	conn, err = dialNode(t, nodes[1].address, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ = requestService(t, conn, frameRelay, "ssh")
+	if status != connectivity.ServiceUnknown {
+		t.Fatalf("Relay frame to a node without the agent: status %d", status)
+	}
+}
+
+func TestClusterPortRequiresClusterCertificate(t *testing.T) {
+	nodes := startCluster(t, newTestCA(t), 1)
+	nodes[0].startAgent(t, "agent", "ssh", startTarget(t, "hello"))
+	eventually(t, "the agent says hello", func() bool {
+		return len(nodes[0].GetMembers()[0].Agents) == 1
+	})
+	conn, err := dialNode(t, nodes[0].address, newTestCA(t).credentials(t, "node-1"))
+	if err == nil {
+		conn.Write([]byte{frameRelay})
+		connectivity.WriteServiceRequest(conn, "ssh")
+		_, err = connectivity.ReadServiceResponse(conn)
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatalf("A node with a certificate of another CA was let in")
+	}
+	conn = dial(t, nodes[0].address)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{frameRelay})
+	connectivity.WriteServiceRequest(conn, "ssh")
+	if status, err := connectivity.ReadServiceResponse(conn); err == nil {
+		t.Fatalf("A plain TCP relay frame got an answer: status %d", status)
+	}
+}
+
+func TestClientConnectionRelayedToAgentNode(t *testing.T) {
+	nodes := startCluster(t, newTestCA(t), 2)
+	nodes[0].startAgent(t, "agent", "ssh", startTarget(t, "hello"))
+	eventually(t, "the second node learns the agent", func() bool {
+		return nodes[1].knows("ssh")
+	})
+	status, greeting := requestService(t, dial(t, nodes[1].client), 0, "ssh")
+	if status != connectivity.ServiceAccepted || greeting != "hello" {
+		t.Fatalf("Client connection at the second node: status %d, greeting %q", status, greeting)
+	}
+	status, _ = requestService(t, dial(t, nodes[1].client), 0, "unknown")
+	if status != connectivity.ServiceUnknown {
+		t.Fatalf("Client connection for a service no node serves: status %d", status)
+	}
+}
+
+func TestUnknownFrameClosesConnection(t *testing.T) {
+	ca := newTestCA(t)
+	nodes := startCluster(t, ca, 1)
+	conn, err := dialNode(t, nodes[0].address, ca.credentials(t, "peer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{'X'})
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the node to close the connection, got: %v", err)
+	}
+}
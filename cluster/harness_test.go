@@ -0,0 +1,225 @@
+package cluster
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+	"project-proxy/agent"
+	"project-proxy/connectivity"
+	"project-proxy/messaging"
+	"project-proxy/server"
+)
+
+// testNode is a cluster node running on localhost together with the server it belongs to.
+type testNode struct {
+	*node
+	registry server.Registry
+	hub      server.Hub
+	control  string
+	transfer string
+	client   string
+}
+
+// testCA issues the certificates of the nodes of a test cluster.
+type testCA struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+	roots       *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	return &testCA{certificate: certificate, key: key, roots: roots}
+}
+
+// credentials issues the credentials of the named node.
+func (ca *testCA) credentials(t *testing.T, name string) Credentials {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Credentials{Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, Roots: ca.roots}
+}
+
+// dialNode opens a cluster connection to the node at address, authenticated with credentials.
+func dialNode(t *testing.T, address string, credentials Credentials) (net.Conn, error) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, credentials.tlsConfig())
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	return conn, err
+}
+
+func tcpFactory(address string) connectivity.ConnFactory {
+	return connectivity.NewTCPConnectionFactory("tcp", address)
+}
+
+// freeAddress returns a localhost address no one listens at.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startCluster runs count nodes on localhost, each on ports of its own with a certificate of ca and seeded with the
+// first node. They stop when the test ends.
+func startCluster(t *testing.T, ca *testCA, count int) []*testNode {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	var nodes []*testNode
+	var seeds []string
+	for i := 0; i < count; i++ {
+		tn := &testNode{
+			registry: server.NewRegistry(),
+			control:  freeAddress(t),
+			transfer: freeAddress(t),
+			client:   freeAddress(t),
+		}
+		balancer, _ := server.NewBalancer(server.BalanceRoundRobin, nil)
+		tn.hub = server.NewHub(tn.registry, nil, tcpFactory(tn.transfer), balancer)
+		tn.hub.SetClientConnFactory(tcpFactory(tn.client))
+		if err := tn.hub.Listen(ctx); err != nil {
+			t.Fatal(err)
+		}
+		controlListener, err := tcpFactory(tn.control).ListenContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go tn.acceptAgents(controlListener)
+		address := freeAddress(t)
+		name := fmt.Sprintf("node-%d", i)
+		tn.node = NewNode(name, address, seeds, 50*time.Millisecond, time.Second, ca.credentials(t, name),
+			connectivity.DefaultConnOptions(), tn.registry, tn.hub).(*node)
+		if err := tn.node.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		tn.hub.SetRelay(tn.node)
+		if i == 0 {
+			seeds = []string{address}
+		}
+		nodes = append(nodes, tn)
+	}
+	return nodes
+}
+
+func (tn *testNode) acceptAgents(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s := server.NewServer(0, 64*1024, messaging.NewMessengerOverlay(messaging.NewMessenger(conn)))
+		s.SetControlConn(conn)
+		s.SetRegistry(tn.registry)
+		s.SetHub(tn.hub)
+		s.Start()
+	}
+}
+
+// startAgent connects an agent serving the service with target as its local target to the node.
+func (tn *testNode) startAgent(t *testing.T, name string, serviceName string, target string) {
+	t.Helper()
+	conn, err := tcpFactory(tn.control).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := agent.NewAgent(tcpFactory(target), tcpFactory(tn.transfer), 0, 64*1024,
+		messaging.NewMessengerOverlay(messaging.NewMessenger(conn)))
+	a.SetIdentity(name, serviceName)
+	a.Start()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+}
+
+// startTarget runs a local target that greets every connection with greeting.
+func startTarget(t *testing.T, greeting string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(greeting))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// eventually fails the test unless condition holds within a few seconds.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting until %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// knows tells if the node knows a live member with an agent serving the service.
+func (tn *testNode) knows(serviceName string) bool {
+	return len(tn.serving(serviceName)) > 0
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"project-proxy/connectivity"
+)
+
+// relayTimeout bounds waiting for the other node's agent to accept a relayed connection.
+const relayTimeout = 30 * time.Second
+
+var errNoNode = errors.New("no other node has an agent for the service")
+
+// Relay opens a connection to the service through another node with an agent for it. The other node serves the
+// connection with its own agents only, so relayed connections never bounce between nodes.
+func (n *node) Relay(serviceName string) (net.Conn, error) {
+	members := n.serving(serviceName)
+	if len(members) == 0 {
+		return nil, errNoNode
+	}
+	var err error
+	for _, m := range members {
+		var conn net.Conn
+		conn, err = n.relayTo(m, serviceName)
+		if err == nil {
+			log.Debugf("Relaying a connection for service: %q to node: %s", serviceName, m.Name)
+			return conn, nil
+		}
+		log.Warningf("Could not relay a connection for service: %q to node: %s Cause: %s", serviceName, m.Name, err)
+	}
+	return nil, err
+}
+
+func (n *node) relayTo(m Member, serviceName string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+	conn, err := n.factory(m.Address).ConnectContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !peerNames(conn, m.Name) {
+		conn.Close()
+		return nil, fmt.Errorf("the node at %s is not %s", m.Address, m.Name)
+	}
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	_, err = conn.Write([]byte{frameRelay})
+	if err == nil {
+		err = connectivity.WriteServiceRequest(conn, serviceName)
+	}
+	var status byte
+	if err == nil {
+		status, err = connectivity.ReadServiceResponse(conn)
+	}
+	if err == nil && status != connectivity.ServiceAccepted {
+		err = fmt.Errorf("the node refused the connection with status %d", status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
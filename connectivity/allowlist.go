@@ -0,0 +1,174 @@
+package connectivity
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrNotAllowed = errors.New("destination is not on the allow-list")
+
+type allowRule struct {
+	network *net.IPNet
+	host    string
+	minPort int
+	maxPort int
+}
+
+// AllowList decides which destinations an agent may dial on behalf of a SOCKS5 client. The agent announces it to the
+// server, which routes SOCKS5 connections to an agent whose list matches. An empty list allows nothing.
+type AllowList []allowRule
+
+// ParseAllowList parses a comma separated list of host[:ports] entries. A host is a name ("nas.lan"), a wildcard
+// domain ("*.lan"), an IP or a CIDR ("192.168.1.0/24", "[fd00::/8]"). Ports are "*", a single port or a range
+// ("8000-8100"); a missing port allows all of them.
+func ParseAllowList(spec string) (AllowList, error) {
+	var list AllowList
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, ports := entry, "*"
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			host, ports = h, p
+		} else if i := strings.LastIndex(entry, ":"); i >= 0 && !strings.Contains(entry[:i], ":") {
+			host, ports = entry[:i], entry[i+1:]
+		}
+		host = strings.Trim(host, "[]")
+		rule := allowRule{minPort: 1, maxPort: 65535}
+		if ports != "*" {
+			low, high := ports, ports
+			if i := strings.Index(ports, "-"); i >= 0 {
+				low, high = ports[:i], ports[i+1:]
+			}
+			var err error
+			rule.minPort, err = strconv.Atoi(low)
+			if err == nil {
+				rule.maxPort, err = strconv.Atoi(high)
+			}
+			if err != nil || rule.minPort < 1 || rule.maxPort > 65535 || rule.minPort > rule.maxPort {
+				return nil, fmt.Errorf("invalid ports in allow-list entry %q", entry)
+			}
+		}
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			rule.network = network
+		} else if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if host != "" {
+			rule.host = strings.ToLower(host)
+		} else {
+			return nil, fmt.Errorf("missing host in allow-list entry %q", entry)
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+// Resolve checks destination against the list and returns the address to dial. Names matched only through
+// a CIDR rule are resolved here and the permitted IP is returned, so a later lookup cannot point elsewhere.
+func (l AllowList) Resolve(destination string) (string, error) {
+	host, portString, err := net.SplitHostPort(destination)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in destination %s", destination)
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	var resolved []net.IP
+	for _, rule := range l {
+		if port < rule.minPort || port > rule.maxPort {
+			continue
+		}
+		if rule.host != "" {
+			if host == rule.host || (strings.HasPrefix(rule.host, "*.") && strings.HasSuffix(host, rule.host[1:])) {
+				return destination, nil
+			}
+			continue
+		}
+		if ip != nil {
+			if rule.network.Contains(ip) {
+				return destination, nil
+			}
+			continue
+		}
+		if resolved == nil {
+			resolved, err = net.LookupIP(host)
+			if err != nil {
+				return "", err
+			}
+		}
+		for _, candidate := range resolved {
+			if rule.network.Contains(candidate) {
+				return net.JoinHostPort(candidate.String(), portString), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: %w", destination, ErrNotAllowed)
+}
+
+// Matches tells if destination is allowed without resolving it: an IP matches the CIDR rules, a name the name rules
+// and the CIDR rules holding one of the resolved IPs of the name. The server resolves names on its own, so a name it
+// cannot resolve matches name rules only.
+func (l AllowList) Matches(destination string, resolved []net.IP) bool {
+	host, portString, err := net.SplitHostPort(destination)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, rule := range l {
+		if port < rule.minPort || port > rule.maxPort {
+			continue
+		}
+		switch {
+		case rule.host != "":
+			if host == rule.host || (strings.HasPrefix(rule.host, "*.") && strings.HasSuffix(host, rule.host[1:])) {
+				return true
+			}
+		case ip != nil:
+			if rule.network.Contains(ip) {
+				return true
+			}
+		default:
+			for _, candidate := range resolved {
+				if rule.network.Contains(candidate) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// String renders the list the way ParseAllowList reads it.
+func (l AllowList) String() string {
+	entries := make([]string, 0, len(l))
+	for _, rule := range l {
+		host := rule.host
+		if rule.network != nil {
+			host = rule.network.String()
+		}
+		ports := "*"
+		if rule.minPort == rule.maxPort {
+			ports = strconv.Itoa(rule.minPort)
+		} else if rule.minPort != 1 || rule.maxPort != 65535 {
+			ports = strconv.Itoa(rule.minPort) + "-" + strconv.Itoa(rule.maxPort)
+		}
+		entries = append(entries, net.JoinHostPort(host, ports))
+	}
+	return strings.Join(entries, ",")
+}
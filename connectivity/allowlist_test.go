@@ -0,0 +1,119 @@
+package connectivity
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseAllowList(t *testing.T) {
+	tests := []struct {
+		spec   string
+		parsed string
+		fails  bool
+	}{
+		{"", "", false},
+		{"nas.lan", "nas.lan:*", false},
+		{"NAS.lan:445", "nas.lan:445", false},
+		{"*.corp:8000-8100", "*.corp:8000-8100", false},
+		{"192.168.1.0/24:22", "192.168.1.0/24:22", false},
+		{"10.0.0.5", "10.0.0.5/32:*", false},
+		{"[fd00::/8]:80-90", "[fd00::/8]:80-90", false},
+		{"[fd00::1]:443", "[fd00::1/128]:443", false},
+		{" a.lan:1 , ,b.lan:* ", "a.lan:1,b.lan:*", false},
+		{":22", "", true},
+		{"nas.lan:0", "", true},
+		{"nas.lan:65536", "", true},
+		{"nas.lan:90-80", "", true},
+		{"nas.lan:ssh", "", true},
+	}
+	for _, test := range tests {
+		list, err := ParseAllowList(test.spec)
+		if (err != nil) != test.fails {
+			t.Errorf("%q: unexpected error: %v", test.spec, err)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		if list.String() != test.parsed {
+			t.Errorf("%q: parsed as %q, expected %q", test.spec, list.String(), test.parsed)
+		}
+		again, err := ParseAllowList(list.String())
+		if err != nil || again.String() != list.String() {
+			t.Errorf("%q: %q does not parse back to itself: %q, %v", test.spec, list.String(), again.String(), err)
+		}
+	}
+}
+
+func TestAllowListMatches(t *testing.T) {
+	list, err := ParseAllowList("nas.lan:445, *.corp, 192.168.1.0/24:22, [fd00::/8]:80-90, 10.0.0.5:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		destination string
+		resolved    []net.IP
+		matches     bool
+	}{
+		{"nas.lan:445", nil, true},
+		{"NAS.lan:445", nil, true},
+		{"nas.lan:22", nil, false},
+		{"files.corp:1", nil, true},
+		{"corp:1", nil, false},
+		{"192.168.1.9:22", nil, true},
+		{"192.168.1.9:23", nil, false},
+		{"192.168.2.9:22", nil, false},
+		{"[fd00::1]:85", nil, true},
+		{"[fe80::1]:85", nil, false},
+		{"10.0.0.5:3", nil, true},
+		{"10.0.0.6:3", nil, false},
+		// Names only match CIDR rules through the IPs they resolve to.
+		{"printer.home:22", nil, false},
+		{"printer.home:22", []net.IP{net.ParseIP("192.168.1.7")}, true},
+		{"printer.home:22", []net.IP{net.ParseIP("172.16.0.1"), net.ParseIP("192.168.1.7")}, true},
+		{"printer.home:22", []net.IP{net.ParseIP("172.16.0.1")}, false},
+		{"printer.home:23", []net.IP{net.ParseIP("192.168.1.7")}, false},
+		{"nas.lan", nil, false},
+		{"nas.lan:x", nil, false},
+	}
+	for _, test := range tests {
+		if matches := list.Matches(test.destination, test.resolved); matches != test.matches {
+			t.Errorf("%s resolved to %v: matches %t, expected %t", test.destination, test.resolved, matches, test.matches)
+		}
+	}
+	var empty AllowList
+	if empty.Matches("192.168.1.9:22", nil) {
+		t.Fatalf("An empty allow-list allowed a destination")
+	}
+}
+
+func TestAllowListResolve(t *testing.T) {
+	list, err := ParseAllowList("nas.lan:445, 127.0.0.0/8:22, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		destination string
+		resolved    string
+		notAllowed  bool
+	}{
+		{"nas.lan:445", "nas.lan:445", false},
+		{"127.0.0.1:22", "127.0.0.1:22", false},
+		{"10.1.2.3:8080", "10.1.2.3:8080", false},
+		// localhost only matches through the CIDR rule, so its permitted IP is dialed.
+		{"localhost:22", "127.0.0.1:22", false},
+		{"127.0.0.1:23", "", true},
+		{"192.168.1.1:445", "", true},
+	}
+	for _, test := range tests {
+		resolved, err := list.Resolve(test.destination)
+		if errors.Is(err, ErrNotAllowed) != test.notAllowed || (!test.notAllowed && err != nil) {
+			t.Errorf("%s: unexpected error: %v", test.destination, err)
+			continue
+		}
+		if resolved != test.resolved {
+			t.Errorf("%s: resolved to %q, expected %q", test.destination, resolved, test.resolved)
+		}
+	}
+}
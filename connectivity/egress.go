@@ -0,0 +1,216 @@
+package connectivity
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Dialer opens the raw connection a ConnFactory builds on. Setting one on a factory (e.g. an egress proxy dialer)
+// keeps TLS and WebSocket layered on top of it. Dialing gives up once ctx is done.
+type Dialer interface {
+	DialContext(ctx context.Context, networkType string, address string) (net.Conn, error)
+}
+
+type egressProxyDialer struct {
+	proxy   *url.URL
+	noProxy []string
+	dialer  net.Dialer
+}
+
+// NewEgressProxyDialer creates a dialer tunnelling through an http, https (HTTP CONNECT) or socks5/socks5h proxy.
+// Credentials are taken from the URL user info. noProxy follows the NO_PROXY convention: a comma separated list
+// of host names, domain suffixes, IPs and CIDRs (each optionally with a port), or "*" to bypass the proxy entirely.
+// The connections to the proxy and those bypassing it keep alive as options say.
+func NewEgressProxyDialer(proxyURL string, noProxy string, options ConnOptions) (Dialer, error) {
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "http://" + proxyURL
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress proxy %q: %s", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported egress proxy scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		defaultPort := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	var entries []string
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return &egressProxyDialer{
+		proxy:   u,
+		noProxy: entries,
+		dialer:  net.Dialer{KeepAlive: options.KeepAlive},
+	}, nil
+}
+
+// EgressProxyFromEnvironment returns the proxy URL from HTTPS_PROXY or ALL_PROXY (upper or lower case)
+// and the NO_PROXY list. An empty URL means no proxy is configured.
+func EgressProxyFromEnvironment() (string, string) {
+	proxyURL := ""
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+		if proxyURL = os.Getenv(name); proxyURL != "" {
+			break
+		}
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	return proxyURL, noProxy
+}
+
+// DialContext connects to address through the proxy. ctx bounds the negotiation with the proxy as well.
+func (d *egressProxyDialer) DialContext(ctx context.Context, networkType string, address string) (net.Conn, error) {
+	if !strings.HasPrefix(networkType, "tcp") || d.bypass(address) {
+		return d.dialer.DialContext(ctx, networkType, address)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach egress proxy %s: %s", d.proxy.Host, err)
+	}
+	username := d.proxy.User.Username()
+	password, _ := d.proxy.User.Password()
+	raw := conn
+	err = runWithDeadline(ctx, raw, func() error {
+		var err error
+		switch d.proxy.Scheme {
+		case "socks5", "socks5h":
+			target := address
+			if d.proxy.Scheme == "socks5" {
+				target, err = resolveLocally(ctx, address)
+			}
+			if err == nil {
+				err = socks5Connect(conn, target, username, password)
+			}
+		case "https":
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+			conn = tlsConn
+			err = tlsConn.Handshake()
+			if err == nil {
+				conn, err = httpConnect(conn, address, username, password)
+			}
+		default:
+			conn, err = httpConnect(conn, address, username, password)
+		}
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy %s could not connect to %s: %s", d.proxy.Host, address, err)
+	}
+	return conn, nil
+}
+
+// bypass reports whether address matches the NO_PROXY list.
+func (d *egressProxyDialer) bypass(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range d.noProxy {
+		if entry == "*" {
+			return true
+		}
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(entryHost); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveLocally(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errors.New("no addresses found for " + host)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+func httpConnect(conn net.Conn, address string, username string, password string) (net.Conn, error) {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	_, err := conn.Write([]byte(request + "\r\n"))
+	if err != nil {
+		return conn, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, errors.New("proxy responded with " + resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps bytes that were read ahead while parsing a handshake response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
@@ -2,35 +2,109 @@ package connectivity
 
 import (
 	"net"
+	"sync"
 	"crypto/x509"
 	"crypto/tls"
+	"context"
+	"time"
+	"project-proxy/metrics"
 )
 
 type ConnFactory interface {
 	Connect() (net.Conn, error)
+	// ConnectContext connects like Connect, giving up once ctx is done.
+	ConnectContext(ctx context.Context) (net.Conn, error)
 	Listen() (net.Listener, error)
+	// ListenContext listens like Listen and closes the listener once ctx is done.
+	ListenContext(ctx context.Context) (net.Listener, error)
 	GetNetworkType() string
 	GetAddress() string
+	SetDialer(dialer Dialer)
+	SetOptions(options ConnOptions)
+}
+
+// ConnOptions bound how long opening a connection may take and how idle connections are kept alive.
+type ConnOptions struct {
+	// DialTimeout bounds establishing the underlying connection. Zero leaves it to the context.
+	DialTimeout time.Duration
+	// HandshakeTimeout bounds the TLS and WebSocket handshakes, both when connecting and when accepting. Zero
+	// leaves it to the context, or unbounded when accepting.
+	HandshakeTimeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes. Zero uses the system default, negative disables them.
+	KeepAlive time.Duration
+}
+
+// DefaultConnOptions returns the options of a factory until SetOptions is called.
+func DefaultConnOptions() ConnOptions {
+	return ConnOptions{
+		DialTimeout:      30 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// DescribeAddress renders an address for log messages, since unix socket paths do not look like ip_addr:port.
+func DescribeAddress(networkType string, address string) string {
+	if IsUnixNetworkType(networkType) {
+		if IsAbstractUnixAddress(address) {
+			return "abstract unix socket " + address
+		}
+		return "unix socket " + address
+	}
+	return networkType + " " + address
 }
 
 type tcpFactory struct {
 	networkType string
 	address     string
+	dialer      Dialer
+	options     ConnOptions
 }
 
 func NewTCPConnectionFactory(networkType string, address string) ConnFactory {
 	return &tcpFactory{
 		networkType: networkType,
 		address:     address,
+		options:     DefaultConnOptions(),
 	}
 }
 
 func (f *tcpFactory) Connect() (net.Conn, error) {
-	return net.Dial(f.networkType, f.address)
+	return f.ConnectContext(context.Background())
+}
+
+func (f *tcpFactory) ConnectContext(ctx context.Context) (net.Conn, error) {
+	return f.dial(ctx)
+}
+
+func (f *tcpFactory) dial(ctx context.Context) (net.Conn, error) {
+	if f.options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.options.DialTimeout)
+		defer cancel()
+	}
+	if f.dialer == nil {
+		dialer := net.Dialer{KeepAlive: f.options.KeepAlive}
+		return dialer.DialContext(ctx, f.networkType, f.address)
+	}
+	return f.dialer.DialContext(ctx, f.networkType, f.address)
 }
 
 func (f *tcpFactory) Listen() (net.Listener, error) {
-	return net.Listen(f.networkType, f.address)
+	return f.ListenContext(context.Background())
+}
+
+func (f *tcpFactory) ListenContext(ctx context.Context) (net.Listener, error) {
+	return f.listen(ctx)
+}
+
+func (f *tcpFactory) listen(ctx context.Context) (net.Listener, error) {
+	config := net.ListenConfig{KeepAlive: f.options.KeepAlive}
+	ln, err := config.Listen(ctx, f.networkType, f.address)
+	if err != nil {
+		return nil, err
+	}
+	closeWhenDone(ctx, ln)
+	return ln, nil
 }
 
 func (f *tcpFactory) GetNetworkType() string {
@@ -41,12 +115,80 @@ func (f *tcpFactory) GetAddress() string {
 	return f.address
 }
 
+func (f *tcpFactory) SetDialer(dialer Dialer) {
+	f.dialer = dialer
+}
+
+func (f *tcpFactory) SetOptions(options ConnOptions) {
+	f.options = options
+}
+
+// handshakeContext bounds a handshake by the handshake timeout on top of ctx.
+func (f *tcpFactory) handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.options.HandshakeTimeout > 0 {
+		return context.WithTimeout(ctx, f.options.HandshakeTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// closeWhenDone closes a listener once ctx is done. Contexts that are never done cost nothing.
+func closeWhenDone(ctx context.Context, ln net.Listener) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+}
+
+// runWithDeadline runs a handshake over conn that cannot take a context itself: the conn's deadline follows ctx, and
+// cancelling ctx aborts the handshake. The deadline is cleared afterwards.
+func runWithDeadline(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := handshake()
+	close(stop)
+	<-stopped
+	conn.SetDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 type tlsFactory struct {
 	tcpFactory
 	config *tls.Config
 }
 
 func NewTLSConnectionFactory(rootCert string, key string, cert string, onlyAllowRootCertSignedClients bool, networkType string, address string) ConnFactory {
+	return NewTLSConnectionFactoryWithConfig(NewTLSConfig(rootCert, key, cert, onlyAllowRootCertSignedClients), networkType, address)
+}
+
+func NewTLSConnectionFactoryWithConfig(config *tls.Config, networkType string, address string) ConnFactory {
+	return &tlsFactory{
+		tcpFactory: tcpFactory{
+			networkType: networkType,
+			address:     address,
+			options:     DefaultConnOptions(),
+		},
+		config: config,
+	}
+}
+
+func NewTLSConfig(rootCert string, key string, cert string, onlyAllowRootCertSignedClients bool) *tls.Config {
 	roots := x509.NewCertPool()
 	ok := roots.AppendCertsFromPEM([]byte(rootCert))
 	if !ok {
@@ -64,21 +206,119 @@ func NewTLSConnectionFactory(rootCert string, key string, cert string, onlyAllow
 		config.ClientCAs = roots
 		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	return &tlsFactory{
-		tcpFactory: tcpFactory{
-			networkType: networkType,
-			address:     address,
-		},
-		config: config,
+	return config
+}
+
+// clientTLSConfig fills in the server name the way tls.Dial would, since the handshake runs over an already dialed conn.
+func clientTLSConfig(config *tls.Config, address string) *tls.Config {
+	if config.ServerName != "" {
+		return config
 	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// NewTunnelConnectionFactory picks the factory for control and transfer connections based on the network type.
+// "ws" and "wss" carry the connections over WebSocket at wsPath, anything else is used directly and wrapped in TLS
+// unless plain is set.
+func NewTunnelConnectionFactory(config *tls.Config, plain bool, networkType string, address string, wsPath string) ConnFactory {
+	switch networkType {
+	case "ws":
+		return NewWebSocketConnectionFactory(nil, address, wsPath)
+	case "wss":
+		return NewWebSocketConnectionFactory(config, address, wsPath)
+	}
+	if plain {
+		return NewTCPConnectionFactory(networkType, address)
+	}
+	return NewTLSConnectionFactoryWithConfig(config, networkType, address)
 }
 
 func (f *tlsFactory) Connect() (net.Conn, error) {
-	return tls.Dial(f.networkType, f.address, f.config)
+	return f.ConnectContext(context.Background())
+}
+
+func (f *tlsFactory) ConnectContext(ctx context.Context) (net.Conn, error) {
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, clientTLSConfig(f.config, f.address))
+	handshakeCtx, cancel := f.handshakeContext(ctx)
+	defer cancel()
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	if err != nil {
+		metrics.TLSHandshakeFailuresTotal.Inc("client")
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 func (f *tlsFactory) Listen() (net.Listener, error) {
-	return tls.Listen(f.networkType, f.address, f.config)
+	return f.ListenContext(context.Background())
+}
+
+func (f *tlsFactory) ListenContext(ctx context.Context) (net.Listener, error) {
+	ln, err := f.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeCountingListener{Listener: tls.NewListener(ln, f.config), timeout: f.options.HandshakeTimeout}, nil
+}
+
+// handshakeCountingListener hands out TLS connections which count a failed handshake. The handshake itself still
+// runs lazily on first use, so a slow client cannot stall Accept; it fails once it takes longer than timeout.
+type handshakeCountingListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *handshakeCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return conn, nil
+	}
+	return &handshakeCountingConn{Conn: tlsConn, timeout: l.timeout}, nil
+}
+
+type handshakeCountingConn struct {
+	*tls.Conn
+	timeout       time.Duration
+	handshakeOnce sync.Once
+}
+
+func (c *handshakeCountingConn) handshake() {
+	c.handshakeOnce.Do(func() {
+		ctx := context.Background()
+		if c.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+		}
+		if c.Conn.HandshakeContext(ctx) != nil {
+			metrics.TLSHandshakeFailuresTotal.Inc("server")
+		}
+	})
+}
+
+func (c *handshakeCountingConn) Read(b []byte) (int, error) {
+	c.handshake()
+	return c.Conn.Read(b)
+}
+
+func (c *handshakeCountingConn) Write(b []byte) (int, error) {
+	c.handshake()
+	return c.Conn.Write(b)
 }
 
 func (f *tlsFactory) GetNetworkType() string {
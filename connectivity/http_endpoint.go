@@ -0,0 +1,116 @@
+package connectivity
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// httpEndpoint is a single HTTP(S) server bound to one address. WebSocket listeners and plain HTTP routes
+// registered for the same address share it, so e.g. control connections, transfer connections and other
+// HTTP routes can all live behind one port.
+type httpEndpoint struct {
+	address  string
+	tls      bool
+	listener net.Listener
+	server   *http.Server
+	mux      *http.ServeMux
+	mutex    sync.Mutex
+	routes   map[string]http.Handler
+	handlers int
+}
+
+var (
+	httpEndpoints      = make(map[string]*httpEndpoint)
+	httpEndpointsMutex sync.Mutex
+)
+
+// HandleHTTP registers an HTTP route on the endpoint bound to address, starting the endpoint with options if
+// necessary. A nil config serves plain HTTP.
+func HandleHTTP(config *tls.Config, address string, options ConnOptions, pattern string, handler http.Handler) error {
+	e, err := acquireHTTPEndpoint(config, address, options)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	e.handlers++
+	e.mutex.Unlock()
+	e.mux.Handle(pattern, handler)
+	return nil
+}
+
+// acquireHTTPEndpoint returns the endpoint bound to address, starting it with options if necessary. The handshake
+// timeout bounds both the TLS handshake and reading the request headers.
+func acquireHTTPEndpoint(config *tls.Config, address string, options ConnOptions) (*httpEndpoint, error) {
+	httpEndpointsMutex.Lock()
+	defer httpEndpointsMutex.Unlock()
+	e := httpEndpoints[address]
+	if e != nil {
+		if e.tls != (config != nil) {
+			return nil, errors.New("address " + address + " is already served with a different TLS setting")
+		}
+		return e, nil
+	}
+	listenConfig := net.ListenConfig{KeepAlive: options.KeepAlive}
+	ln, err := listenConfig.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		ln = &handshakeCountingListener{Listener: tls.NewListener(ln, config), timeout: options.HandshakeTimeout}
+	}
+	e = &httpEndpoint{
+		address:  address,
+		tls:      config != nil,
+		listener: ln,
+		mux:      http.NewServeMux(),
+		routes:   make(map[string]http.Handler),
+	}
+	e.server = &http.Server{Handler: e, ReadHeaderTimeout: options.HandshakeTimeout}
+	httpEndpoints[address] = e
+	go func() {
+		err := e.server.Serve(ln)
+		if err != http.ErrServerClosed {
+			log.Errorf("HTTP endpoint at %s has stopped. Cause: %s", address, err)
+		}
+	}()
+	return e, nil
+}
+
+func (e *httpEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	route := e.routes[r.URL.Path]
+	e.mutex.Unlock()
+	if route != nil {
+		route.ServeHTTP(w, r)
+		return
+	}
+	e.mux.ServeHTTP(w, r)
+}
+
+func (e *httpEndpoint) addRoute(path string, handler http.Handler) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.routes[path] != nil {
+		return errors.New("path " + path + " is already in use at " + e.address)
+	}
+	e.routes[path] = handler
+	return nil
+}
+
+// removeRoute drops a route and shuts the endpoint down once nothing is registered on it anymore.
+func (e *httpEndpoint) removeRoute(path string) {
+	httpEndpointsMutex.Lock()
+	defer httpEndpointsMutex.Unlock()
+	e.mutex.Lock()
+	delete(e.routes, path)
+	unused := len(e.routes) == 0 && e.handlers == 0
+	e.mutex.Unlock()
+	if unused && httpEndpoints[e.address] == e {
+		delete(httpEndpoints, e.address)
+		e.server.Close()
+	}
+}
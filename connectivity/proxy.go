@@ -1,25 +1,60 @@
 package connectivity
 
 import (
+	"errors"
 	"net"
 	"io"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 	"project-proxy/logs"
 )
 
 var log = logs.GetLoggerForModule("proxy")
 
+// CloseReason tells why a proxy has finished. It is decided by whatever ended the proxying first.
+type CloseReason string
+
+const (
+	CloseEOFA    CloseReason = "eof_a"
+	CloseEOFB    CloseReason = "eof_b"
+	CloseError   CloseReason = "error"
+	CloseTimeout CloseReason = "timeout"
+	CloseStopped CloseReason = "stopped"
+	// CloseIdle and CloseMaxLifetime tell that the proxy closed its connections because a limit was reached.
+	CloseIdle        CloseReason = "idle"
+	CloseMaxLifetime CloseReason = "max_lifetime"
+)
+
 type proxy struct {
 	connA net.Conn
 	connB net.Conn
-	onFinished func(connA net.Conn, connB net.Conn)
+	bytesAToB uint64
+	bytesBToA uint64
+	onFinished func(connA net.Conn, connB net.Conn, reason CloseReason)
+	onTransfer func(aToB int, bToA int)
+	logger     *logs.Logger
+	stopped    int32
+	reason     CloseReason
+	reasonOnce sync.Once
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	lastActivity int64
 }
 
 type ConnProxy interface {
 	Run()
 	RunAsync()
 	Stop()
-	SetOnFinishedListener(onFinished func(connA net.Conn, connB net.Conn))
+	SetOnFinishedListener(onFinished func(connA net.Conn, connB net.Conn, reason CloseReason))
+	SetOnTransferListener(onTransfer func(aToB int, bToA int))
+	GetBytesTransferred() (aToB uint64, bToA uint64)
+	SetLogFields(keyvals ...interface{})
+	// SetIdleTimeout closes both connections once no bytes went either way for timeout. Zero disables it.
+	SetIdleTimeout(timeout time.Duration)
+	// SetMaxLifetime closes both connections once the proxy has run for lifetime. Zero disables it.
+	SetMaxLifetime(lifetime time.Duration)
 }
 
 func NewConnProxy(connA net.Conn, connB net.Conn) ConnProxy {
@@ -27,57 +62,214 @@ func NewConnProxy(connA net.Conn, connB net.Conn) ConnProxy {
 		connA: connA,
 		connB: connB,
 		onFinished: nil,
+		onTransfer: nil,
+		logger: log,
 	}
 }
 
 func (p *proxy) Run() {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+	finished := make(chan struct{})
+	if p.idleTimeout > 0 || p.maxLifetime > 0 {
+		go p.watchLimits(finished)
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		continuousBufferCopy(p.connA, p.connB)
+		err := continuousBufferCopy(p.logger, p.connA, &countingWriter{conn: p.connB, count: func(n int) {
+			atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+			atomic.AddUint64(&p.bytesAToB, uint64(n))
+			if p.onTransfer != nil {
+				p.onTransfer(n, 0)
+			}
+		}})
+		p.setReason(CloseEOFA, err)
+		p.finishDirection(p.connB, err)
 		wg.Done()
 	}()
 	go func () {
-		continuousBufferCopy(p.connB, p.connA)
+		err := continuousBufferCopy(p.logger, p.connB, &countingWriter{conn: p.connA, count: func(n int) {
+			atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+			atomic.AddUint64(&p.bytesBToA, uint64(n))
+			if p.onTransfer != nil {
+				p.onTransfer(0, n)
+			}
+		}})
+		p.setReason(CloseEOFB, err)
+		p.finishDirection(p.connA, err)
 		wg.Done()
 	}()
 	wg.Wait()
-	p.Stop()
+	close(finished)
+	p.closeConns()
 	if p.onFinished != nil {
-		p.onFinished(p.connA, p.connB)
+		p.onFinished(p.connA, p.connB, p.reason)
+	}
+}
+
+// finishDirection ends one copy direction. A source that was closed cleanly is passed on as a half-close of dest, so
+// the other direction keeps running until its source closes as well; a failed copy closes both connections.
+func (p *proxy) finishDirection(dest net.Conn, err error) {
+	if err != nil {
+		p.closeConns()
+		return
+	}
+	err = CloseWrite(dest)
+	if err != nil {
+		p.logger.Debugf("Could not pass the end of the stream on. Closing the proxy. Cause: %s", err)
+		p.closeConns()
+	}
+}
+
+// CloseWrite shuts down the write side of conn, telling its peer that no more bytes follow while it can still be
+// read. Connections that cannot half-close are closed completely.
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
 	}
+	return conn.Close()
+}
+
+// setReason records why the proxy finished, unless an earlier copy already did. eof is the reason for a copy
+// that ended because its source closed.
+func (p *proxy) setReason(eof CloseReason, err error) {
+	p.reasonOnce.Do(func() {
+		var netErr net.Error
+		switch {
+		case atomic.LoadInt32(&p.stopped) == 1:
+			p.reason = CloseStopped
+		case err == nil:
+			p.reason = eof
+		case errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+			p.reason = CloseTimeout
+		default:
+			p.reason = CloseError
+		}
+	})
 }
 
 func (p *proxy) RunAsync() {
 	go p.Run()
 }
 
+// watchLimits closes both connections once the idle timeout or the max lifetime is reached, recording it as the
+// reason the proxy finished.
+func (p *proxy) watchLimits(finished chan struct{}) {
+	started := time.Now()
+	timer := time.NewTimer(p.untilLimit(started))
+	defer timer.Stop()
+	for {
+		select {
+		case <-finished:
+			return
+		case <-timer.C:
+		}
+		if p.maxLifetime > 0 && time.Since(started) >= p.maxLifetime {
+			p.closeForLimit(CloseMaxLifetime, "The connection reached its max lifetime of %s. Closing the proxy", p.maxLifetime)
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+		if p.idleTimeout > 0 && idle >= p.idleTimeout {
+			p.closeForLimit(CloseIdle, "The connection was idle for %s. Closing the proxy", p.idleTimeout)
+			return
+		}
+		timer.Reset(p.untilLimit(started))
+	}
+}
+
+// untilLimit returns the time left until the earlier of the two limits could be reached.
+func (p *proxy) untilLimit(started time.Time) time.Duration {
+	var wait time.Duration = -1
+	if p.maxLifetime > 0 {
+		wait = p.maxLifetime - time.Since(started)
+	}
+	if p.idleTimeout > 0 {
+		untilIdle := p.idleTimeout - time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+		if wait < 0 || untilIdle < wait {
+			wait = untilIdle
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+func (p *proxy) closeForLimit(reason CloseReason, format string, limit time.Duration) {
+	p.reasonOnce.Do(func() {
+		p.reason = reason
+	})
+	p.logger.Infof(format, limit)
+	p.closeConns()
+}
+
+// Stop closes both connections. The proxy finishes with CloseStopped unless it has already finished.
 func (p *proxy) Stop() {
+	atomic.StoreInt32(&p.stopped, 1)
+	p.closeConns()
+}
+
+func (p *proxy) closeConns() {
 	err := p.connA.Close()
 	if err != nil {
-		log.Noticef("Could not close connection while stopping the proxy. Proxy will be stopped regardless. Cause: %s", err)
+		p.logger.Noticef("Could not close connection while stopping the proxy. Proxy will be stopped regardless. Cause: %s", err)
 	}
 	err = p.connB.Close()
 	if err != nil {
-		log.Noticef("Could not close connection while stopping the proxy. Proxy will be stopped regardless. Cause: %s", err)
+		p.logger.Noticef("Could not close connection while stopping the proxy. Proxy will be stopped regardless. Cause: %s", err)
 	}
 }
 
-func (p *proxy) SetOnFinishedListener(onFinished func(connA net.Conn, connB net.Conn)) {
+func (p *proxy) SetOnFinishedListener(onFinished func(connA net.Conn, connB net.Conn, reason CloseReason)) {
 	p.onFinished = onFinished
 }
 
-func continuousBufferCopy(src net.Conn, dest net.Conn) error {
+// SetOnTransferListener is called after every write with the number of bytes that went each way.
+func (p *proxy) SetOnTransferListener(onTransfer func(aToB int, bToA int)) {
+	p.onTransfer = onTransfer
+}
+
+// SetLogFields attaches fields, e.g. the connection id, to everything the proxy logs.
+func (p *proxy) SetLogFields(keyvals ...interface{}) {
+	p.logger = log.With(keyvals...)
+}
+
+func (p *proxy) SetIdleTimeout(timeout time.Duration) {
+	p.idleTimeout = timeout
+}
+
+func (p *proxy) SetMaxLifetime(lifetime time.Duration) {
+	p.maxLifetime = lifetime
+}
+
+func (p *proxy) GetBytesTransferred() (uint64, uint64) {
+	return atomic.LoadUint64(&p.bytesAToB), atomic.LoadUint64(&p.bytesBToA)
+}
+
+type countingWriter struct {
+	conn  net.Conn
+	count func(n int)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.conn.Write(b)
+	if n > 0 {
+		w.count(n)
+	}
+	return n, err
+}
+
+func continuousBufferCopy(logger *logs.Logger, src net.Conn, dest io.Writer) error {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Warningf("Buffer copying ended with a panic which was recovered. Cause: %s", r)
+			logger.Warningf("Buffer copying ended with a panic which was recovered. Cause: %s", r)
 		}
 	}()
 	len, err := io.Copy(dest, src)
 	if err != nil {
-		log.Warningf("Buffer copying ended with an error. Closing the proxy. Cause: %s", err)
+		logger.Warningf("Buffer copying ended with an error. Closing the proxy. Cause: %s", err)
 	} else if len == 0 {
-		log.Warningf("Buffer copying ended after transfering zero bytes. One of the connections was likely corrupt. Closing the proxy. Cause is uknown (len == 0)")
+		logger.Warningf("Buffer copying ended after transfering zero bytes. One of the connections was likely corrupt. Closing the proxy. Cause is uknown (len == 0)")
 	}
 	return err
 }
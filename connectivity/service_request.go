@@ -0,0 +1,55 @@
+package connectivity
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// Replies to a service request sent by a client over the server's client connection.
+const (
+	ServiceAccepted    byte = iota
+	ServiceUnknown
+	ServiceUnavailable
+)
+
+const maxServiceNameLength = 1024
+
+// WriteServiceRequest asks the server for a named agent service. It is the first thing a client sends on its connection.
+func WriteServiceRequest(conn net.Conn, serviceName string) error {
+	if len(serviceName) > maxServiceNameLength {
+		return errors.New("service name is too long")
+	}
+	err := binary.Write(conn, binary.LittleEndian, uint16(len(serviceName)))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(serviceName))
+	return err
+}
+
+func ReadServiceRequest(conn net.Conn) (string, error) {
+	length := uint16(0)
+	err := binary.Read(conn, binary.LittleEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	if length > maxServiceNameLength {
+		return "", errors.New("service name is too long")
+	}
+	name := make([]byte, length)
+	_, err = io.ReadFull(conn, name)
+	return string(name), err
+}
+
+func WriteServiceResponse(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{status})
+	return err
+}
+
+func ReadServiceResponse(conn net.Conn) (byte, error) {
+	status := make([]byte, 1)
+	_, err := io.ReadFull(conn, status)
+	return status[0], err
+}
@@ -0,0 +1,254 @@
+package connectivity
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPassword = 0x02
+	socks5AuthNoAcceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	Socks5ReplySucceeded          = 0x00
+	Socks5ReplyGeneralFailure     = 0x01
+	Socks5ReplyNotAllowed         = 0x02
+	Socks5ReplyHostUnreachable    = 0x04
+	Socks5ReplyCommandUnsupported = 0x07
+	Socks5ReplyAddressUnsupported = 0x08
+)
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to address. Empty credentials skip authentication.
+func socks5Connect(conn net.Conn, address string, username string, password string) error {
+	methods := []byte{socks5AuthNone}
+	if username != "" {
+		methods = []byte{socks5AuthNone, socks5AuthUserPassword}
+	}
+	_, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthUserPassword:
+		if username == "" {
+			return errors.New("SOCKS5 proxy requires authentication")
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials are too long")
+		}
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 proxy rejected the credentials")
+		}
+	default:
+		return errors.New("SOCKS5 proxy accepts none of the offered authentication methods")
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+	request, err = appendSocks5Address(request, address)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 3)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != Socks5ReplySucceeded {
+		return fmt.Errorf("SOCKS5 proxy could not connect to %s (reply code %d)", address, header[1])
+	}
+	_, err = readSocks5Address(conn)
+	return err
+}
+
+func appendSocks5Address(b []byte, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("host name is too long for SOCKS5")
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocks5Address reads an ATYP-prefixed address and port and returns it as host:port.
+func readSocks5Address(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(r, length)
+		if err == nil {
+			name := make([]byte, length[0])
+			_, err = io.ReadFull(r, name)
+			host = string(name)
+		}
+	default:
+		return "", errSocks5AddressType
+	}
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+var errSocks5AddressType = errors.New("unsupported SOCKS5 address type")
+
+// Socks5AcceptConnect performs the server side of a SOCKS5 handshake and returns the requested destination and the
+// username the client authenticated with. With a password, clients must authenticate with username and password
+// (RFC 1929) and give that password. Without one, they may connect without authentication, or give a username and
+// any password. The caller answers with WriteSocks5Reply once the outcome of the connect is known.
+func Socks5AcceptConnect(conn net.Conn, password string) (string, string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5Version {
+		return "", "", fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", "", err
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthUserPassword || (m == socks5AuthNone && password == "" && method == socks5AuthNoAcceptable) {
+			method = m
+		}
+	}
+	_, err = conn.Write([]byte{socks5Version, method})
+	if err != nil {
+		return "", "", err
+	}
+	var username string
+	switch method {
+	case socks5AuthNoAcceptable:
+		return "", "", errors.New("SOCKS5 client does not support authenticating with username and password")
+	case socks5AuthUserPassword:
+		username, err = socks5AcceptUserPassword(conn, password)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	request := make([]byte, 3)
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		return "", "", err
+	}
+	if request[1] != socks5CmdConnect {
+		WriteSocks5Reply(conn, Socks5ReplyCommandUnsupported)
+		return "", "", fmt.Errorf("unsupported SOCKS5 command %d", request[1])
+	}
+	destination, err := readSocks5Address(conn)
+	if err == errSocks5AddressType {
+		WriteSocks5Reply(conn, Socks5ReplyAddressUnsupported)
+	}
+	return destination, username, err
+}
+
+// socks5AcceptUserPassword reads the username and password of a client and checks the password unless it is empty.
+func socks5AcceptUserPassword(conn net.Conn, password string) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", err
+	}
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.ReadFull(conn, header[1:])
+	if err != nil {
+		return "", err
+	}
+	given := make([]byte, header[1])
+	_, err = io.ReadFull(conn, given)
+	if err != nil {
+		return "", err
+	}
+	if password != "" && subtle.ConstantTimeCompare(given, []byte(password)) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return "", errors.New("SOCKS5 client gave a wrong password")
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return string(username), err
+}
+
+func WriteSocks5Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,50 @@
+package connectivity
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn presents the process' stdin and stdout as a connection, e.g. for use as an SSH ProxyCommand.
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+}
+
+func NewStdioConn() net.Conn {
+	return &stdioConn{
+		in:  os.Stdin,
+		out: os.Stdout,
+	}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+// CloseWrite closes stdout only, so the process at the other end sees the end of the stream while stdin still
+// delivers what it sends.
+func (c *stdioConn) CloseWrite() error {
+	return c.out.Close()
+}
+
+func (c *stdioConn) Close() error {
+	c.in.Close()
+	return c.out.Close()
+}
+
+func (c *stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
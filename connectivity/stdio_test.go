@@ -0,0 +1,37 @@
+package connectivity
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestStdioCloseWriteKeepsReading(t *testing.T) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinWriter.Close()
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdoutReader.Close()
+	conn := &stdioConn{in: stdinReader, out: stdoutWriter}
+	defer conn.Close()
+
+	conn.Write([]byte("request"))
+	if err := CloseWrite(conn); err != nil {
+		t.Fatal(err)
+	}
+	request, err := io.ReadAll(stdoutReader)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("Stdout delivered %q, %v before the end of the stream", request, err)
+	}
+	stdinWriter.Write([]byte("response"))
+	stdinWriter.Close()
+	response, err := io.ReadAll(conn)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("Stdin delivered %q, %v after stdout was closed", response, err)
+	}
+}
@@ -0,0 +1,147 @@
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+type unixFactory struct {
+	tcpFactory
+	owner string
+	mode  os.FileMode
+}
+
+// NewUnixConnectionFactory creates a factory for unix domain sockets. The owner ("user[:group]", names or numeric ids)
+// and the mode are applied to the socket file after listening; an empty owner or a zero mode leaves them untouched.
+// Addresses starting with '@' are placed in the Linux abstract namespace, which has no file to clean up or chmod.
+func NewUnixConnectionFactory(networkType string, address string, owner string, mode os.FileMode) ConnFactory {
+	return &unixFactory{
+		tcpFactory: tcpFactory{
+			networkType: networkType,
+			address:     address,
+			options:     DefaultConnOptions(),
+		},
+		owner: owner,
+		mode:  mode,
+	}
+}
+
+func IsUnixNetworkType(networkType string) bool {
+	return networkType == "unix" || networkType == "unixpacket"
+}
+
+func IsAbstractUnixAddress(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// ParseSocketMode parses an octal file mode such as "0660". An empty string yields zero, which means "do not chmod".
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode %q: %s", mode, err)
+	}
+	return os.FileMode(parsed) & os.ModePerm, nil
+}
+
+func (f *unixFactory) Listen() (net.Listener, error) {
+	return f.ListenContext(context.Background())
+}
+
+func (f *unixFactory) ListenContext(ctx context.Context) (net.Listener, error) {
+	if IsAbstractUnixAddress(f.address) {
+		return f.listen(ctx)
+	}
+	err := removeStaleSocket(f.networkType, f.address)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := f.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.mode != 0 {
+		err = os.Chmod(f.address, f.mode)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("could not set mode %#o on socket %s: %s", f.mode, f.address, err)
+		}
+	}
+	if f.owner != "" {
+		uid, gid, err := lookupOwner(f.owner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		err = os.Chown(f.address, uid, gid)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("could not set owner %s on socket %s: %s", f.owner, f.address, err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous process. Files that are not sockets,
+// and sockets something is still listening on, are left alone.
+func removeStaleSocket(networkType string, address string) error {
+	info, err := os.Lstat(address)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s: file exists and is not a socket", address)
+	}
+	conn, err := net.Dial(networkType, address)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is already in use", address)
+	}
+	log.Noticef("Removing stale unix socket %s", address)
+	return os.Remove(address)
+}
+
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown socket owner %q", userName)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if groupName == "" {
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown socket group %q", groupName)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid == -1 && gid == -1 {
+		return 0, 0, errors.New("empty socket owner")
+	}
+	return uid, gid, nil
+}
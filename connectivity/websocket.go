@@ -0,0 +1,407 @@
+package connectivity
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"project-proxy/logs"
+	"project-proxy/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+type webSocketFactory struct {
+	tcpFactory
+	config *tls.Config
+	path   string
+}
+
+// NewWebSocketConnectionFactory creates a factory carrying connections over WebSocket. With a nil config it speaks
+// plain ws, otherwise wss. Listening shares the HTTP endpoint with every other WebSocket path or HTTP route
+// registered for the same address.
+func NewWebSocketConnectionFactory(config *tls.Config, address string, path string) ConnFactory {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return &webSocketFactory{
+		tcpFactory: tcpFactory{
+			networkType: "tcp",
+			address:     address,
+			options:     DefaultConnOptions(),
+		},
+		config: config,
+		path:   path,
+	}
+}
+
+func (f *webSocketFactory) Connect() (net.Conn, error) {
+	return f.ConnectContext(context.Background())
+}
+
+// ConnectContext bounds the TLS handshake and the WebSocket upgrade together by the handshake timeout.
+func (f *webSocketFactory) ConnectContext(ctx context.Context) (net.Conn, error) {
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	handshakeCtx, cancel := f.handshakeContext(ctx)
+	defer cancel()
+	if f.config != nil {
+		tlsConn := tls.Client(conn, clientTLSConfig(f.config, f.address))
+		err = tlsConn.HandshakeContext(handshakeCtx)
+		if err != nil {
+			metrics.TLSHandshakeFailuresTotal.Inc("client")
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	var ws net.Conn
+	err = runWithDeadline(handshakeCtx, conn, func() error {
+		ws, err = webSocketClientHandshake(conn, f.address, f.path)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func (f *webSocketFactory) GetNetworkType() string {
+	if f.config != nil {
+		return "wss"
+	}
+	return "ws"
+}
+
+func (f *webSocketFactory) Listen() (net.Listener, error) {
+	return f.ListenContext(context.Background())
+}
+
+// ListenContext registers the path on the HTTP endpoint of the address. The endpoint takes its handshake timeout and
+// keep-alive from the first factory listening at the address.
+func (f *webSocketFactory) ListenContext(ctx context.Context) (net.Listener, error) {
+	e, err := acquireHTTPEndpoint(f.config, f.address, f.options)
+	if err != nil {
+		return nil, err
+	}
+	l := &webSocketListener{
+		endpoint: e,
+		path:     f.path,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	err = e.addRoute(f.path, l)
+	if err != nil {
+		return nil, err
+	}
+	closeWhenDone(ctx, l)
+	return l, nil
+}
+
+func webSocketClientHandshake(conn net.Conn, address string, path string) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: path},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       address,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade rejected with status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("websocket upgrade returned an invalid Sec-WebSocket-Accept")
+	}
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type webSocketListener struct {
+	endpoint  *httpEndpoint
+	path      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *webSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.With(logs.FieldClientAddress, r.RemoteAddr).Warningf("Could not take over a websocket upgrade request. Cause: %s", err)
+		return
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	ws := newWebSocketConn(conn, rw.Reader, false)
+	select {
+	case l.conns <- ws:
+	case <-l.closed:
+		ws.Close()
+	}
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("websocket listener at " + l.endpoint.address + l.path + " is closed")
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.endpoint.removeRoute(l.path)
+	})
+	return nil
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.endpoint.listener.Addr()
+}
+
+// webSocketConn exposes the binary messages of a WebSocket as a plain byte stream.
+type webSocketConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	client        bool
+	writeMutex    sync.Mutex
+	remaining     uint64
+	masked        bool
+	mask          [4]byte
+	maskPos       int
+	closeSent     bool
+	closeReceived bool
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:   conn,
+		reader: reader,
+		client: client,
+	}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	if c.closeReceived {
+		return 0, io.EOF
+	}
+	for c.remaining == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame starts, answering control frames on the way.
+func (c *webSocketConn) nextFrame() error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return err
+	}
+	c.masked = header[1]&0x80 != 0
+	c.maskPos = 0
+	if c.masked {
+		_, err = io.ReadFull(c.reader, c.mask[:])
+		if err != nil {
+			return err
+		}
+	}
+	switch opcode {
+	case wsOpContinuation, wsOpBinary:
+		c.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > 125 {
+			return errors.New("websocket control frame too long")
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(c.reader, payload)
+		if err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i%4]
+			}
+		}
+		if opcode == wsOpClose {
+			// The close frame of this side answers it once this side is done writing as well, see CloseWrite.
+			c.closeReceived = true
+			return io.EOF
+		} else if opcode == wsOpPing {
+			return c.writeFrame(wsOpPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported websocket opcode %d", opcode)
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	err := c.writeFrame(wsOpBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return errors.New("websocket is closed")
+	}
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// CloseWrite sends the close frame, which tells the peer that no more messages follow. The peer may go on sending
+// until it answers with a close frame of its own.
+func (c *webSocketConn) CloseWrite() error {
+	return c.writeFrame(wsOpClose, nil)
+}
+
+func (c *webSocketConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,57 @@
+package connectivity
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWebSocketCloseWriteKeepsReading(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := NewWebSocketConnectionFactory(nil, "127.0.0.1:0", "/ws").ListenContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := NewWebSocketConnectionFactory(nil, ln.Addr().String(), "/ws").Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the websocket connection")
+	}
+	defer server.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	client.Write([]byte("request"))
+	if err := CloseWrite(client); err != nil {
+		t.Fatal(err)
+	}
+	request, err := io.ReadAll(server)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("The server read %q, %v before the end of the stream", request, err)
+	}
+	// The client only closed its write side, so it still reads the response.
+	server.Write([]byte("response"))
+	if err := CloseWrite(server); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("The client read %q, %v after closing its write side", response, err)
+	}
+}
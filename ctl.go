@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"github.com/jamiealquiza/envy"
+	"project-proxy/admin"
+	"project-proxy/certs"
+	"project-proxy/connectivity"
+	"project-proxy/events"
+	"project-proxy/logs"
+	"project-proxy/server"
+)
+
+const usage = `Usage: ctl [flags] <command> [arguments]
+
+Commands:
+  agents                 list connected agents
+  connections            list active tunneled connections
+  traffic                show per-service connections and bytes
+  kill <connection id>   forcibly close a connection
+  disconnect <agent>     disconnect an agent
+  events                 print events as they happen
+  log-level              list log levels
+  log-level <target> <level>
+                         change a log level; the target is a module, "default" or field=value
+                         (e.g. conn_id=123, agent=nas) and the level a name, 0-5 or "reset"
+
+Flags:
+`
+
+func main() {
+	adminAddress := flag.String("admin-addr", "127.0.0.1:9200", "The ip_addr:port combination of the server's admin API")
+	adminToken := flag.String("admin-token", "", "Bearer token of the admin API")
+	useTLS := flag.Bool("tls", false, "If true, connects over TLS and authenticates with a client certificate")
+	certFile := flag.String("tls-cert-file", "", "PEM file with the client certificate, signed by the admin CA of the server. Required by tls")
+	keyFile := flag.String("tls-key-file", "", "PEM file with the private key of the client certificate")
+	outputJSON := flag.Bool("json", false, "If true, prints JSON instead of tables")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+
+	envy.Parse("APP")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var c admin.Client
+	if *useTLS {
+		if *certFile == "" || *keyFile == "" {
+			fmt.Fprintln(os.Stderr, "Connecting over TLS needs a client certificate and its key")
+			os.Exit(2)
+		}
+		cert, key := readFile(*certFile), readFile(*keyFile)
+		c = admin.NewClient(*adminAddress, *adminToken, connectivity.NewTLSConfig(certs.RootCertificate, key, cert, false))
+	} else {
+		c = admin.NewClient(*adminAddress, *adminToken, nil)
+	}
+
+	var err error
+	switch command := flag.Arg(0); command {
+	case "agents":
+		var agents []server.AgentInfo
+		agents, err = c.GetAgents()
+		if err == nil {
+			printOutput(*outputJSON, agents, "NAME\tADDRESS\tSERVICE\tVERSION\tCONNECTED\tRTT\tHEALTH\tIDENTITY", func(w *tabwriter.Writer) {
+				for _, a := range agents {
+					rtt := "-"
+					if a.RTT.Samples > 0 {
+						rtt = fmt.Sprintf("%.1fms", a.RTT.Avg)
+					}
+					health := a.Health
+					if a.HealthReason != "" {
+						health += " (" + a.HealthReason + ")"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.Name, a.Address, a.Service, a.Version,
+						a.ConnectedAt.Format(time.RFC3339), rtt, health, a.Identity)
+				}
+			})
+		}
+	case "connections":
+		var conns []server.ConnectionInfo
+		conns, err = c.GetConnections()
+		if err == nil {
+			printOutput(*outputJSON, conns, "ID\tCLIENT\tSERVICE\tAGENT\tAGE\tPROXIED\tIN\tOUT", func(w *tabwriter.Writer) {
+				for _, conn := range conns {
+					fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%t\t%d\t%d\n", conn.Id, conn.ClientAddress, conn.Service, conn.Agent,
+						time.Duration(conn.AgeSeconds*float64(time.Second)).Round(time.Second), conn.Proxied, conn.BytesIn, conn.BytesOut)
+				}
+			})
+		}
+	case "traffic":
+		var traffic []admin.ServiceTraffic
+		traffic, err = c.GetTraffic()
+		if err == nil {
+			printOutput(*outputJSON, traffic, "SERVICE\tACTIVE\tTOTAL\tIN\tOUT", func(w *tabwriter.Writer) {
+				for _, t := range traffic {
+					fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", t.Service, t.ActiveConnections, t.TotalConnections, t.BytesIn, t.BytesOut)
+				}
+			})
+		}
+	case "kill":
+		var id uint64
+		id, err = strconv.ParseUint(flag.Arg(1), 10, 32)
+		if err == nil {
+			err = c.CloseConnection(uint32(id))
+		}
+	case "disconnect":
+		err = c.DisconnectAgent(flag.Arg(1))
+	case "events":
+		err = c.TailEvents(func(e events.Event) {
+			if *outputJSON {
+				json.NewEncoder(os.Stdout).Encode(e)
+				return
+			}
+			fmt.Printf("%s %-18s agent=%s service=%s conn=%d client=%s in=%d out=%d %s\n", e.Time.Format(time.RFC3339),
+				e.Type, e.Agent, e.Service, e.ConnectionId, e.ClientAddress, e.BytesIn, e.BytesOut, e.Message)
+		})
+	case "log-level":
+		var levels logs.Levels
+		if flag.NArg() == 1 {
+			levels, err = c.GetLogLevels()
+		} else {
+			levels, err = c.SetLogLevel(parseLevelChange(flag.Arg(1), flag.Arg(2)))
+		}
+		if err == nil {
+			printOutput(*outputJSON, levels, "TARGET\tLEVEL", func(w *tabwriter.Writer) {
+				modules := make([]string, 0, len(levels.Modules))
+				for module := range levels.Modules {
+					modules = append(modules, module)
+				}
+				sort.Strings(modules)
+				for _, module := range modules {
+					target := module
+					if target == "" {
+						target = "default"
+					}
+					fmt.Fprintf(w, "%s\t%s\n", target, levels.Modules[module])
+				}
+				for _, scoped := range levels.Scoped {
+					fmt.Fprintf(w, "%s=%s\t%s\n", scoped.Key, scoped.Value, scoped.Level)
+				}
+			})
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func parseLevelChange(target string, level string) admin.LevelChange {
+	change := admin.LevelChange{Level: level}
+	if i := strings.Index(target, "="); i >= 0 {
+		change.Field, change.Value = target[:i], target[i+1:]
+	} else if target != "default" {
+		change.Module = target
+	}
+	return change
+}
+
+func printOutput(asJSON bool, value interface{}, header string, rows func(w *tabwriter.Writer)) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(value)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	rows(w)
+	w.Flush()
+}
+
+func readFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	return string(b)
+}
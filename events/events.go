@@ -0,0 +1,75 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published over the lifetime of agents and tunneled connections.
+const (
+	AgentConnected    = "agent_connected"
+	AgentDisconnected = "agent_disconnected"
+	ConnectionOpened  = "connection_opened"
+	ConnectionClosed  = "connection_closed"
+	// ServiceUp is published when the first agent serving a service connects, ServiceDown when the last one leaves.
+	ServiceUp   = "service_up"
+	ServiceDown = "service_down"
+	// TargetUnhealthy is published when an agent reports its local target unhealthy, TargetHealthy when it recovers.
+	TargetUnhealthy = "target_unhealthy"
+	TargetHealthy   = "target_healthy"
+	// CertificateExpiring is published while a certificate of the server or of a connected agent is about to expire.
+	CertificateExpiring = "certificate_expiring"
+)
+
+type Event struct {
+	Time          time.Time  `json:"time"`
+	Type          string     `json:"type"`
+	Agent         string     `json:"agent,omitempty"`
+	Service       string     `json:"service,omitempty"`
+	ConnectionId  uint32     `json:"connectionId,omitempty"`
+	ClientAddress string     `json:"clientAddress,omitempty"`
+	BytesIn       uint64     `json:"bytesIn,omitempty"`
+	BytesOut      uint64     `json:"bytesOut,omitempty"`
+	Message       string     `json:"message,omitempty"`
+	Certificate   string     `json:"certificate,omitempty"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+}
+
+const subscriberBuffer = 256
+
+var (
+	subscribers      = make(map[chan Event]bool)
+	subscribersMutex sync.Mutex
+)
+
+// Publish hands the event to every subscriber. A subscriber that does not keep up misses events
+// instead of slowing down the publisher.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every published event and a function to stop the subscription.
+func Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	subscribersMutex.Lock()
+	subscribers[ch] = true
+	subscribersMutex.Unlock()
+	return ch, func() {
+		subscribersMutex.Lock()
+		defer subscribersMutex.Unlock()
+		if subscribers[ch] {
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/messaging"
+)
+
+var (
+	errTimeout      = errors.New("the check timed out")
+	errDisconnected = errors.New("the control connection is not established")
+)
+
+// ControlConn tracks the current control connection for a readiness check.
+type ControlConn struct {
+	mutex       sync.Mutex
+	overlay     messaging.MessengerOverlay
+	connectedAt time.Time
+}
+
+// Connected records that a control connection using overlay was established.
+func (c *ControlConn) Connected(overlay messaging.MessengerOverlay) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.overlay = overlay
+	c.connectedAt = time.Now()
+}
+
+func (c *ControlConn) Disconnected() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.overlay = nil
+}
+
+// Check fails unless a control connection is established and, if maxSilence is positive, a pong arrived within
+// maxSilence. A new connection gets maxSilence for its first pong.
+func (c *ControlConn) Check(maxSilence time.Duration) Check {
+	return func() error {
+		c.mutex.Lock()
+		overlay, connectedAt := c.overlay, c.connectedAt
+		c.mutex.Unlock()
+		if overlay == nil {
+			return errDisconnected
+		}
+		if maxSilence <= 0 {
+			return nil
+		}
+		last := overlay.GetRTTStats().LastAt
+		if last.Before(connectedAt) {
+			last = connectedAt
+		}
+		if silence := time.Since(last); silence > maxSilence {
+			return fmt.Errorf("no pong for %s", silence.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// Reachable fails unless a connection can be made with the factory, e.g. to the agent's local service.
+func Reachable(factory connectivity.ConnFactory) Check {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		conn, err := factory.ConnectContext(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
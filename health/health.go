@@ -0,0 +1,117 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+	"project-proxy/logs"
+)
+
+var log = logs.GetLoggerForModule("health")
+
+const checkTimeout = 5 * time.Second
+
+// Check returns nil if whatever it checks is ready.
+type Check func() error
+
+// Checker serves liveness at /healthz, which answers 200 as long as the process serves HTTP, and readiness at /readyz,
+// which answers 200 only if every readiness check passes and 503 otherwise. Both reply with a Status.
+type Checker interface {
+	AddReadinessCheck(name string, check Check)
+	Handler() http.Handler
+}
+
+type Status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+const (
+	StatusOK       = "ok"
+	StatusNotReady = "not_ready"
+)
+
+type checker struct {
+	names  []string
+	checks map[string]Check
+	mutex  sync.Mutex
+}
+
+func NewChecker() Checker {
+	return &checker{
+		checks: make(map[string]Check),
+	}
+}
+
+func (c *checker) AddReadinessCheck(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+func (c *checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusOK, Status{Status: StatusOK})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := c.runChecks()
+		if status.Status != StatusOK {
+			writeStatus(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeStatus(w, http.StatusOK, status)
+	})
+	return mux
+}
+
+// runChecks runs the readiness checks concurrently. A check taking longer than checkTimeout fails.
+func (c *checker) runChecks() Status {
+	c.mutex.Lock()
+	names := append([]string(nil), c.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mutex.Unlock()
+
+	results := make([]chan error, len(checks))
+	for i, check := range checks {
+		results[i] = make(chan error, 1)
+		go func(check Check, result chan error) {
+			result <- check()
+		}(check, results[i])
+	}
+	status := Status{Status: StatusOK, Checks: make(map[string]string)}
+	deadline := time.After(checkTimeout)
+	for i, name := range names {
+		var err error
+		select {
+		case err = <-results[i]:
+		case <-deadline:
+			err = errTimeout
+		}
+		if err != nil {
+			status.Status = StatusNotReady
+			status.Checks[name] = err.Error()
+			log.Debugf("Readiness check %s failed. Cause: %s", name, err)
+		} else {
+			status.Checks[name] = StatusOK
+		}
+	}
+	return status
+}
+
+func writeStatus(w http.ResponseWriter, code int, status Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Warningf("Could not write a health response. Cause: %s", err)
+	}
+}
@@ -0,0 +1,227 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"project-proxy/events"
+	"project-proxy/logs"
+)
+
+var log = logs.GetLoggerForModule("hooks")
+
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultRetryDelay = time.Second
+	// queueSize bounds the events waiting for a slow hook. Further events are dropped and logged.
+	queueSize = 256
+)
+
+// Hook is run for every event of one of its Events, or of any type if Events is empty. It either runs Command with
+// the event as JSON on stdin, or POSTs the event as JSON to URL. A failed run (a non-zero exit status, a non-2xx
+// response, or exceeding Timeout) is retried up to Retries times with a doubling delay.
+type Hook struct {
+	Events     []string          `json:"events,omitempty"`
+	Command    string            `json:"command,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Timeout    Duration          `json:"timeout,omitempty"`
+	Retries    int               `json:"retries,omitempty"`
+	RetryDelay Duration          `json:"retryDelay,omitempty"`
+}
+
+// Duration is a time.Duration read from JSON as a string like "10s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadHooks reads a JSON array of hooks from a file.
+func LoadHooks(path string) ([]Hook, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	err = json.Unmarshal(b, &hooks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hooks file %s: %s", path, err)
+	}
+	return hooks, nil
+}
+
+// ParseEventTypes splits a comma separated list of event types. An empty list matches every event.
+func ParseEventTypes(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// Start validates the hooks and runs each of them for the events published from now on.
+func Start(hooks []Hook) error {
+	for i, h := range hooks {
+		if (h.Command == "") == (h.URL == "") {
+			return fmt.Errorf("hook %d needs either a command or a URL", i)
+		}
+	}
+	for _, h := range hooks {
+		h := h
+		ch, _ := events.Subscribe()
+		queue := make(chan events.Event, queueSize)
+		go func() {
+			for e := range ch {
+				if !h.matches(e.Type) {
+					continue
+				}
+				select {
+				case queue <- e:
+				default:
+					log.Warningf("Hook %s is too slow. Dropping the %s event", h.name(), e.Type)
+				}
+			}
+		}()
+		go func() {
+			for e := range queue {
+				h.deliver(e)
+			}
+		}()
+		log.Infof("Running hook %s for events: %s", h.name(), h.eventList())
+	}
+	return nil
+}
+
+func (h *Hook) matches(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hook) name() string {
+	if h.Command != "" {
+		return h.Command
+	}
+	return h.URL
+}
+
+func (h *Hook) eventList() string {
+	if len(h.Events) == 0 {
+		return "all"
+	}
+	return strings.Join(h.Events, ",")
+}
+
+// deliver runs the hook for an event, retrying failed runs.
+func (h *Hook) deliver(e events.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Could not encode the %s event for hook %s. Cause: %s", e.Type, h.name(), err)
+		return
+	}
+	delay := time.Duration(h.RetryDelay)
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		err = h.run(e.Type, payload)
+		if err == nil {
+			log.Debugf("Hook %s handled the %s event", h.name(), e.Type)
+			return
+		}
+		if attempt >= h.Retries {
+			log.Errorf("Hook %s failed for the %s event after %d attempts. Giving up. Cause: %s", h.name(), e.Type, attempt+1, err)
+			return
+		}
+		log.Warningf("Hook %s failed for the %s event. Retrying in %s. Cause: %s", h.name(), e.Type, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (h *Hook) run(eventType string, payload []byte) error {
+	timeout := time.Duration(h.Timeout)
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	if h.Command != "" {
+		err = h.runCommand(ctx, eventType, payload)
+	} else {
+		err = h.post(ctx, payload)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+func (h *Hook) runCommand(ctx context.Context, eventType string, payload []byte) error {
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "PROXY_EVENT_TYPE="+eventType)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+func (h *Hook) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
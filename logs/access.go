@@ -0,0 +1,123 @@
+package logs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	AccessFormatCommon = "common"
+	AccessFormatJSON   = "json"
+)
+
+// AccessRecord describes a tunneled connection once it has closed. BytesIn flows from the client towards the
+// agent, BytesOut back.
+type AccessRecord struct {
+	ConnId        uint32
+	ClientAddress string
+	Agent         string
+	Service       string
+	Destination   string
+	Start         time.Time
+	Duration      time.Duration
+	BytesIn       uint64
+	BytesOut      uint64
+	CloseReason   string
+}
+
+// AccessLog writes exactly one line per record, separately from the application logs.
+type AccessLog interface {
+	Log(record AccessRecord)
+}
+
+type accessLog struct {
+	out    io.Writer
+	format string
+	mutex  sync.Mutex
+}
+
+// NewAccessLog writes access records to out in the common or json format.
+func NewAccessLog(format string, out io.Writer) (AccessLog, error) {
+	if format == "" {
+		format = AccessFormatCommon
+	}
+	if format != AccessFormatCommon && format != AccessFormatJSON {
+		return nil, errors.New("unknown access log format: " + format)
+	}
+	return &accessLog{out: out, format: format}, nil
+}
+
+// OpenAccessLog writes access records to a file that is rotated like the application log file. A path of "-"
+// writes to stdout.
+func OpenAccessLog(format string, path string, maxSizeMB int, maxBackups int) (AccessLog, error) {
+	if path == "-" {
+		return NewAccessLog(format, os.Stdout)
+	}
+	out, err := newRotatingFile(path, int64(maxSizeMB)*1024*1024, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return NewAccessLog(format, out)
+}
+
+func (a *accessLog) Log(r AccessRecord) {
+	var line []byte
+	if a.format == AccessFormatJSON {
+		line = formatAccessJSON(r)
+	} else {
+		line = formatAccessCommon(r)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.out.Write(line)
+}
+
+// formatAccessCommon follows the Common Log Format where it can: the agent takes the place of the user, the
+// service and destination the place of the request and the close reason the place of the status.
+//
+//	192.0.2.7:51234 - nas [19/Oct/2026:10:02:11 +0000] "ssh -" client_eof 3127 48211 12.480 2791558932
+func formatAccessCommon(r AccessRecord) []byte {
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s\" %s %d %d %.3f %d\n",
+		orDash(r.ClientAddress), orDash(r.Agent), r.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		orDash(r.Service), orDash(r.Destination), orDash(r.CloseReason), r.BytesIn, r.BytesOut,
+		r.Duration.Seconds(), r.ConnId))
+}
+
+func formatAccessJSON(r AccessRecord) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, r.Start.Add(r.Duration).Format(time.RFC3339Nano))
+	fields := []interface{}{
+		FieldConnId, r.ConnId,
+		FieldClientAddress, r.ClientAddress,
+		FieldAgent, r.Agent,
+		FieldService, r.Service,
+		"destination", r.Destination,
+		"start", r.Start.Format(time.RFC3339Nano),
+		"duration_seconds", r.Duration.Seconds(),
+		"bytes_in", r.BytesIn,
+		"bytes_out", r.BytesOut,
+		"close_reason", r.CloseReason,
+	}
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, fields[i])
+		buf.WriteByte(':')
+		writeJSONValue(&buf, fields[i+1])
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,55 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// jsonBackend writes one JSON object per record: time, level, module, msg and then the record's fields.
+type jsonBackend struct {
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	line := formatJSON(level, rec)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, err := b.out.Write(line)
+	return err
+}
+
+func formatJSON(level logging.Level, rec *logging.Record) []byte {
+	message, fields := recordEntry(rec)
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, rec.Time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level.String())
+	buf.WriteString(`,"module":`)
+	writeJSONValue(&buf, rec.Module)
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, message)
+	for i := 0; i+1 < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSONValue(&buf, fieldValue(fields[i+1]))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
+}
@@ -0,0 +1,251 @@
+package logs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+var log = GetLoggerForModule("logs")
+
+// ScopedLevel raises the level of every record whose fields contain Key with Value, e.g. conn_id=123 or
+// agent=nas, whatever module writes it.
+type ScopedLevel struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Level string `json:"level"`
+}
+
+// Levels describes the level of every module ("" is the default for modules without one) and the scoped levels.
+type Levels struct {
+	Modules map[string]string `json:"modules"`
+	Scoped  []ScopedLevel     `json:"scoped"`
+}
+
+type scope struct {
+	key   string
+	value string
+	level logging.Level
+}
+
+// levelFilter is the leveled backend that decides what gets logged. Besides the per-module levels it knows
+// the scoped levels, which go-logging itself cannot evaluate as they depend on the fields of a record.
+type levelFilter struct {
+	backend  logging.Backend
+	mutex    sync.RWMutex
+	levels   map[string]logging.Level
+	scopes   []scope
+	maxScope logging.Level
+	initial  map[string]logging.Level
+}
+
+var filter = &levelFilter{
+	levels:  map[string]logging.Level{"": logging.INFO},
+	initial: map[string]logging.Level{"": logging.INFO},
+}
+
+// install makes the filter, with the given startup levels, pass records on to backend.
+func (f *levelFilter) install(backend logging.Backend, initial map[string]logging.Level) {
+	f.mutex.Lock()
+	f.backend = backend
+	f.initial = initial
+	f.mutex.Unlock()
+	ResetLevels()
+	logging.SetBackend(f)
+}
+
+func (f *levelFilter) GetLevel(module string) logging.Level {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.moduleLevel(module)
+}
+
+func (f *levelFilter) moduleLevel(module string) logging.Level {
+	if level, ok := f.levels[module]; ok {
+		return level
+	}
+	return f.levels[""]
+}
+
+func (f *levelFilter) SetLevel(level logging.Level, module string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.levels[module] = level
+}
+
+// IsEnabledFor is what go-logging asks before creating a record. It lets through whatever a scoped level might
+// want, the final decision is made in Log once the fields are known.
+func (f *levelFilter) IsEnabledFor(level logging.Level, module string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return level <= f.moduleLevel(module) || len(f.scopes) > 0 && level <= f.maxScope
+}
+
+func (f *levelFilter) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	_, fields := recordEntry(rec)
+	if !f.enabled(level, rec.Module, fields) {
+		return nil
+	}
+	return f.backend.Log(level, calldepth+1, rec)
+}
+
+func (f *levelFilter) enabled(level logging.Level, module string, fields []interface{}) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if level <= f.moduleLevel(module) {
+		return true
+	}
+	if len(f.scopes) == 0 || level > f.maxScope {
+		return false
+	}
+	for _, s := range f.scopes {
+		if level > s.level {
+			continue
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fmt.Sprint(fields[i]) == s.key && fmt.Sprint(fieldValue(fields[i+1])) == s.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *levelFilter) updateMaxScope() {
+	f.maxScope = logging.CRITICAL
+	for _, s := range f.scopes {
+		if s.level > f.maxScope {
+			f.maxScope = s.level
+		}
+	}
+}
+
+// ParseLevel accepts a level number (0 CRITICAL to 5 DEBUG) or name.
+func ParseLevel(level string) (int, error) {
+	if n, err := strconv.Atoi(level); err == nil {
+		if n < int(logging.CRITICAL) || n > int(logging.DEBUG) {
+			return 0, fmt.Errorf("log level %d is out of range", n)
+		}
+		return n, nil
+	}
+	parsed, err := logging.LogLevel(level)
+	if err != nil {
+		return 0, fmt.Errorf("unknown log level: %s", level)
+	}
+	return int(parsed), nil
+}
+
+// ParseModuleLevels parses a comma separated list of module=level pairs, e.g. "server=debug,proxy=2". A level
+// without a module sets the default.
+func ParseModuleLevels(spec string) (map[string]int, error) {
+	levels := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		module, level := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			module, level = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if module == "" {
+				return nil, errors.New("missing module in log level entry: " + entry)
+			}
+		}
+		parsed, err := ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		levels[module] = parsed
+	}
+	return levels, nil
+}
+
+// SetModuleLevel changes the level of one module, or the default level if module is empty.
+func SetModuleLevel(module string, level int) {
+	filter.SetLevel(logging.Level(level), module)
+}
+
+// ResetModuleLevel makes a module use the default level again.
+func ResetModuleLevel(module string) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	if module == "" {
+		filter.levels[""] = filter.initial[""]
+		return
+	}
+	delete(filter.levels, module)
+}
+
+// SetScopedLevel logs records carrying the field key=value at level or below, e.g. all DEBUG records of a single
+// connection.
+func SetScopedLevel(key string, value string, level int) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	for i, s := range filter.scopes {
+		if s.key == key && s.value == value {
+			filter.scopes[i].level = logging.Level(level)
+			filter.updateMaxScope()
+			return
+		}
+	}
+	filter.scopes = append(filter.scopes, scope{key: key, value: value, level: logging.Level(level)})
+	filter.updateMaxScope()
+}
+
+func ClearScopedLevel(key string, value string) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	for i, s := range filter.scopes {
+		if s.key == key && s.value == value {
+			filter.scopes = append(filter.scopes[:i], filter.scopes[i+1:]...)
+			break
+		}
+	}
+	filter.updateMaxScope()
+}
+
+// ResetLevels restores the levels set at startup and drops all scoped levels.
+func ResetLevels() {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.levels = make(map[string]logging.Level)
+	for module, level := range filter.initial {
+		filter.levels[module] = level
+	}
+	filter.scopes = nil
+	filter.updateMaxScope()
+}
+
+// RaiseDefaultLevel makes the default level one step more verbose, wrapping around from DEBUG to the level set at
+// startup. It returns the new level.
+func RaiseDefaultLevel() logging.Level {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	level := filter.levels[""] + 1
+	if level > logging.DEBUG {
+		level = filter.initial[""]
+	}
+	filter.levels[""] = level
+	return level
+}
+
+func GetLevels() Levels {
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	levels := Levels{Modules: make(map[string]string), Scoped: []ScopedLevel{}}
+	for module, level := range filter.levels {
+		levels.Modules[module] = level.String()
+	}
+	for _, s := range filter.scopes {
+		levels.Scoped = append(levels.Scoped, ScopedLevel{Key: s.key, Value: s.value, Level: s.level.String()})
+	}
+	sort.Slice(levels.Scoped, func(i, j int) bool {
+		return levels.Scoped[i].Key+"="+levels.Scoped[i].Value < levels.Scoped[j].Key+"="+levels.Scoped[j].Value
+	})
+	return levels
+}
@@ -0,0 +1,189 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/op/go-logging"
+)
+
+// Keys of the structured fields attached to log records.
+const (
+	FieldConnId        = "conn_id"
+	FieldService       = "service"
+	FieldAgent         = "agent"
+	FieldClientAddress = "client_addr"
+	FieldPeerAddress   = "peer_addr"
+)
+
+// Logger is a module logger carrying structured fields. Every record it writes has the fields attached; the text
+// format appends them as key=value pairs, the JSON format and journald store them as separate fields.
+type Logger struct {
+	base   *logging.Logger
+	fields []interface{}
+}
+
+func GetLoggerForModule(module string) *Logger {
+	base := logging.MustGetLogger(module)
+	base.ExtraCalldepth = 2
+	return &Logger{base: base}
+}
+
+// With returns a logger that adds the given key, value pairs to the fields of l.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "")
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{base: l.base, fields: fields}
+}
+
+// Fields returns the key, value pairs attached to l.
+func (l *Logger) Fields() []interface{} {
+	return append([]interface{}(nil), l.fields...)
+}
+
+func (l *Logger) Module() string {
+	return l.base.Module
+}
+
+// IsEnabledFor tells whether l writes records of level, taking the levels scoped to its fields into account.
+func (l *Logger) IsEnabledFor(level logging.Level) bool {
+	return filter.enabled(level, l.base.Module, l.fields)
+}
+
+func (l *Logger) log(level logging.Level, format *string, args []interface{}) {
+	if !l.IsEnabledFor(level) {
+		return
+	}
+	e := &entry{format: format, args: args, fields: l.fields}
+	switch level {
+	case logging.CRITICAL:
+		l.base.Critical(e)
+	case logging.ERROR:
+		l.base.Error(e)
+	case logging.WARNING:
+		l.base.Warning(e)
+	case logging.NOTICE:
+		l.base.Notice(e)
+	case logging.INFO:
+		l.base.Info(e)
+	default:
+		l.base.Debug(e)
+	}
+}
+
+func (l *Logger) Fatal(args ...interface{}) {
+	l.log(logging.CRITICAL, nil, args)
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(logging.CRITICAL, &format, args)
+	os.Exit(1)
+}
+
+func (l *Logger) Critical(args ...interface{}) {
+	l.log(logging.CRITICAL, nil, args)
+}
+
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	l.log(logging.CRITICAL, &format, args)
+}
+
+func (l *Logger) Error(args ...interface{}) {
+	l.log(logging.ERROR, nil, args)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(logging.ERROR, &format, args)
+}
+
+func (l *Logger) Warning(args ...interface{}) {
+	l.log(logging.WARNING, nil, args)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(logging.WARNING, &format, args)
+}
+
+func (l *Logger) Notice(args ...interface{}) {
+	l.log(logging.NOTICE, nil, args)
+}
+
+func (l *Logger) Noticef(format string, args ...interface{}) {
+	l.log(logging.NOTICE, &format, args)
+}
+
+func (l *Logger) Info(args ...interface{}) {
+	l.log(logging.INFO, nil, args)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(logging.INFO, &format, args)
+}
+
+func (l *Logger) Debug(args ...interface{}) {
+	l.log(logging.DEBUG, nil, args)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(logging.DEBUG, &format, args)
+}
+
+// entry is the single argument a Logger hands to go-logging. Backends that understand fields unpack it, the
+// plain text formatter just prints it.
+type entry struct {
+	format *string
+	args   []interface{}
+	fields []interface{}
+}
+
+func (e *entry) message() string {
+	if e.format != nil {
+		return fmt.Sprintf(*e.format, e.args...)
+	}
+	message := fmt.Sprintln(e.args...)
+	return message[:len(message)-1]
+}
+
+func (e *entry) String() string {
+	if len(e.fields) == 0 {
+		return e.message()
+	}
+	var buf bytes.Buffer
+	buf.WriteString(e.message())
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		fmt.Fprintf(&buf, " %v=%v", e.fields[i], fieldValue(e.fields[i+1]))
+	}
+	return buf.String()
+}
+
+// recordEntry returns the message and fields of a record written through a Logger.
+func recordEntry(rec *logging.Record) (string, []interface{}) {
+	if len(rec.Args) == 1 {
+		if e, ok := rec.Args[0].(*entry); ok {
+			return e.message(), e.fields
+		}
+	}
+	return rec.Message(), nil
+}
+
+// fieldValue turns a field value into something that prints and marshals sensibly.
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string, bool, int, int32, int64, uint, uint16, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
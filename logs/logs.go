@@ -1,20 +1,118 @@
 package logs
 
 import (
-	"github.com/op/go-logging"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+
+	"github.com/op/go-logging"
+)
+
+// Output formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Sinks the logs can be written to.
+const (
+	SinkStdout   = "stdout"
+	SinkStderr   = "stderr"
+	SinkFile     = "file"
+	SinkSyslog   = "syslog"
+	SinkJournald = "journald"
 )
 
+type Options struct {
+	Level int
+	// ModuleLevels overrides Level for single modules, see ParseModuleLevels.
+	ModuleLevels   string
+	Format         string
+	Sink           string
+	File           string
+	FileMaxSizeMB  int
+	FileMaxBackups int
+	// Tag identifies the process in syslog and journald. Defaults to the executable name.
+	Tag string
+}
+
+const textFormat = `%{time:15:04:05.000} %{module} ► %{level:.4s} %{id:03x} %{message}`
+const colorTextFormat = `%{color}%{time:15:04:05.000} %{module} ► %{level:.4s} %{id:03x}%{color:reset} %{message}`
+
 func Init(logLevel int) {
-	backend := logging.NewLogBackend(os.Stdout, "", 0)
-	formatter := logging.NewBackendFormatter(backend, logging.MustStringFormatter(
-		`%{color}%{time:15:04:05.000} %{module} ► %{level:.4s} %{id:03x}%{color:reset} %{message}`,
-	))
-	leveled := logging.AddModuleLevel(formatter)
-	leveled.SetLevel(logging.Level(logLevel), "")
-	logging.SetBackend(leveled)
+	InitWithOutput(logLevel, os.Stdout)
+}
+
+func InitWithOutput(logLevel int, out io.Writer) {
+	setBackend(logLevel, nil, textBackend(out, colorTextFormat))
+}
+
+// InitWithOptions sets up logging as described by options. Nothing is changed if it returns an error.
+func InitWithOptions(options Options) error {
+	if options.Format == "" {
+		options.Format = FormatText
+	}
+	if options.Format != FormatText && options.Format != FormatJSON {
+		return errors.New("unknown log format: " + options.Format)
+	}
+	moduleLevels, err := ParseModuleLevels(options.ModuleLevels)
+	if err != nil {
+		return err
+	}
+	if options.Tag == "" {
+		options.Tag = filepath.Base(os.Args[0])
+	}
+	var backend logging.Backend
+	switch options.Sink {
+	case "", SinkStdout, SinkStderr:
+		out := os.Stdout
+		if options.Sink == SinkStderr {
+			out = os.Stderr
+		}
+		if options.Format == FormatJSON {
+			backend = &jsonBackend{out: out}
+		} else {
+			backend = textBackend(out, colorTextFormat)
+		}
+	case SinkFile:
+		if options.File == "" {
+			return errors.New("the file sink needs a log file path")
+		}
+		out, err := newRotatingFile(options.File, int64(options.FileMaxSizeMB)*1024*1024, options.FileMaxBackups)
+		if err != nil {
+			return err
+		}
+		if options.Format == FormatJSON {
+			backend = &jsonBackend{out: out}
+		} else {
+			backend = textBackend(out, textFormat)
+		}
+	case SinkSyslog:
+		backend, err = newSyslogBackend(options.Tag, options.Format)
+		if err != nil {
+			return err
+		}
+	case SinkJournald:
+		backend, err = newJournaldBackend(options.Tag)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown log sink: " + options.Sink)
+	}
+	setBackend(options.Level, moduleLevels, backend)
+	return nil
+}
+
+func textBackend(out io.Writer, format string) logging.Backend {
+	return logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), logging.MustStringFormatter(format))
 }
 
-func GetLoggerForModule(module string) *logging.Logger {
-	return logging.MustGetLogger(module)
+func setBackend(logLevel int, moduleLevels map[string]int, backend logging.Backend) {
+	initial := map[string]logging.Level{"": logging.Level(logLevel)}
+	for module, level := range moduleLevels {
+		initial[module] = logging.Level(level)
+	}
+	filter.install(backend, initial)
 }
@@ -0,0 +1,7 @@
+//go:build windows || plan9
+
+package logs
+
+// HandleLevelSignals does nothing, this platform has no user signals. Use the admin API instead.
+func HandleLevelSignals() {
+}
@@ -0,0 +1,27 @@
+//go:build !windows && !plan9
+
+package logs
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleLevelSignals changes the levels on signals: SIGUSR1 makes the default level one step more verbose,
+// wrapping around to the startup level after DEBUG, and SIGUSR2 restores the startup levels.
+func HandleLevelSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				level := RaiseDefaultLevel()
+				log.Noticef("The default log level has been changed to %s on %s", level, sig)
+			} else {
+				ResetLevels()
+				log.Noticef("The log levels have been reset to the startup levels on %s", sig)
+			}
+		}
+	}()
+}
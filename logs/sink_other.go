@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package logs
+
+import (
+	"errors"
+
+	"github.com/op/go-logging"
+)
+
+func newSyslogBackend(tag string, format string) (logging.Backend, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func newJournaldBackend(tag string) (logging.Backend, error) {
+	return nil, errors.New("journald is not supported on this platform")
+}
@@ -0,0 +1,128 @@
+//go:build !windows && !plan9
+
+package logs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+type syslogBackend struct {
+	writer *syslog.Writer
+	format string
+}
+
+func newSyslogBackend(tag string, format string) (logging.Backend, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogBackend{writer: writer, format: format}, nil
+}
+
+func (b *syslogBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	var line string
+	if b.format == FormatJSON {
+		line = string(formatJSON(level, rec))
+	} else {
+		line = rec.Module + " ► " + rec.Message()
+	}
+	switch level {
+	case logging.CRITICAL:
+		return b.writer.Crit(line)
+	case logging.ERROR:
+		return b.writer.Err(line)
+	case logging.WARNING:
+		return b.writer.Warning(line)
+	case logging.NOTICE:
+		return b.writer.Notice(line)
+	case logging.INFO:
+		return b.writer.Info(line)
+	default:
+		return b.writer.Debug(line)
+	}
+}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldBackend speaks the native journal protocol, so that the fields of a record become journal fields
+// (conn_id becomes CONN_ID and so on) and can be filtered on with journalctl.
+type journaldBackend struct {
+	conn  *net.UnixConn
+	tag   string
+	mutex sync.Mutex
+}
+
+func newJournaldBackend(tag string) (logging.Backend, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldBackend{conn: conn, tag: tag}, nil
+}
+
+func (b *journaldBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	message, fields := recordEntry(rec)
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(syslogPriority(level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", b.tag)
+	writeJournalField(&buf, "LOG_MODULE", rec.Module)
+	for i := 0; i+1 < len(fields); i += 2 {
+		writeJournalField(&buf, journalFieldName(fmt.Sprint(fields[i])), fmt.Sprint(fieldValue(fields[i+1])))
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, err := b.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournalField uses the length-prefixed form for values containing new lines, as the protocol requires.
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(name)
+	if strings.Contains(value, "\n") {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] == '_' || name[0] >= '0' && name[0] <= '9' {
+		return "F" + string(name)
+	}
+	return string(name)
+}
+
+func syslogPriority(level logging.Level) int {
+	switch level {
+	case logging.CRITICAL:
+		return 2
+	case logging.ERROR:
+		return 3
+	case logging.WARNING:
+		return 4
+	case logging.NOTICE:
+		return 5
+	case logging.INFO:
+		return 6
+	default:
+		return 7
+	}
+}
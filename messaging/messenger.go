@@ -15,6 +15,7 @@ type messenger struct {
 	stopListeningOnErr   bool
 	onMessageReceived    func(message interface{}, err error)
 	getNewMessagePointer func() interface{}
+	log                  *logs.Logger
 }
 
 type Messenger interface {
@@ -22,6 +23,7 @@ type Messenger interface {
 	SetTimeout(timeout time.Duration)
 	Send(message interface{}) error
 	Start()
+	Close() error
 }
 
 var l = logs.GetLoggerForModule("mess")
@@ -34,6 +36,7 @@ func NewMessenger(conn net.Conn) Messenger {
 		stopListeningOnErr:   true,
 		onMessageReceived:    nil,
 		getNewMessagePointer: nil,
+		log:                  l.With(logs.FieldPeerAddress, conn.RemoteAddr()),
 	}
 }
 
@@ -52,15 +55,19 @@ func (m *messenger) Send(message interface{}) error {
 	}
 	err := m.enc.Encode(message)
 	if err != nil {
-		l.Errorf("Could not encode a message. Closing the connection. Cause: %s", err)
+		m.log.Errorf("Could not encode a message. Closing the connection. Cause: %s", err)
 		m.conn.Close()
 	}
 	return err
 }
 
+func (m *messenger) Close() error {
+	return m.conn.Close()
+}
+
 func (m *messenger) Start() {
 	if m.timeout == 0 {
-		l.Warningf("Timeout is disabled. Please check if this is as intended")
+		m.log.Warningf("Timeout is disabled. Please check if this is as intended")
 	}
 	go func() {
 		for {
@@ -70,10 +77,10 @@ func (m *messenger) Start() {
 			}
 			err := m.dec.Decode(message)
 			if err != nil {
-				l.Errorf("Could not decode a message. Cause: %s", err)
+				m.log.Errorf("Could not decode a message. Cause: %s", err)
 				m.onMessageReceived(nil, err)
 				if m.stopListeningOnErr {
-					log.Info("Closing the control connection since [config] stopListeningOnErr is TRUE")
+					m.log.Info("Closing the control connection since [config] stopListeningOnErr is TRUE")
 					m.conn.Close()
 					return
 				}
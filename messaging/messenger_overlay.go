@@ -1,6 +1,10 @@
 package messaging
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"project-proxy/logs"
 )
 
@@ -9,33 +13,68 @@ const (
 	Ping
 	OpenConnection
 	CloseConnection
+	Hello
+	Pong
+	ServiceHealth
 )
 
+// ErrPeerDead is returned by SendPing once the peer has left too many pings unanswered.
+var ErrPeerDead = errors.New("the peer has not answered the recent pings")
+
 type message struct {
 	Type         uint8
 	RemoteConnId uint32
 	Service      uint32
 	Payload      []byte
+	Destination  string
+	AgentName    string
+	ServiceName  string
+	AgentVersion string
+	Seq          uint64
+	Timestamp    int64
+	TraceParent  string
+	SessionToken string
+	AllowList    string
+	Healthy      bool
+	Reason       string
 }
 
 type messengerOverlay struct {
-	messenger         Messenger
-	onForward         func(remoteConnId uint32, service uint32, payload []byte, err error)
-	onOpenConn        func(remoteConnId uint32, service uint32, err error)
-	onCloseConn       func(remoteConnId uint32, err error)
-	onControlConnLost func(err error)
+	messenger           Messenger
+	onForward           func(remoteConnId uint32, service uint32, payload []byte, err error)
+	onOpenConn          func(remoteConnId uint32, service uint32, destination string, traceParent string, err error)
+	onCloseConn         func(remoteConnId uint32, err error)
+	onHello             func(agentName string, serviceName string, agentVersion string, sessionToken string, allowList string, err error)
+	onControlConnLost   func(err error)
+	onPong              func(rtt time.Duration, stats RTTStats)
+	onServiceHealth     func(healthy bool, reason string, err error)
+	controlConnLostOnce sync.Once
+	rtt                 rttTracker
+	pingMutex           sync.Mutex
+	pingSeq             uint64
+	lastPongSeq         uint64
+	pongSeen            bool
+	maxMissedPongs      int
 }
 
 type MessengerOverlay interface {
 	Start()
 	SetOnForwardListener(onForward func(remoteConnId uint32, service uint32, payload []byte, err error))
-	SetOnOpenConnectionListener(onOpenConn func(remoteConnId uint32, service uint32, err error))
+	SetOnOpenConnectionListener(onOpenConn func(remoteConnId uint32, service uint32, destination string, traceParent string, err error))
 	SetOnCloseConnectionListener(onCloseConn func(remoteConnId uint32, err error))
+	SetOnHelloListener(onHello func(agentName string, serviceName string, agentVersion string, sessionToken string, allowList string, err error))
 	SetOnControlConnectionLostListener(onControlConnLost func(err error))
+	SetOnPongListener(onPong func(rtt time.Duration, stats RTTStats))
+	SetOnServiceHealthListener(onServiceHealth func(healthy bool, reason string, err error))
+	SetMaxMissedPongs(maxMissedPongs int)
+	GetRTTStats() RTTStats
 	SendForward(remoteConnId uint32, service uint32, payload []byte) error
-	SendOpenConn(remoteConnId uint32, service uint32) error
+	SendOpenConn(remoteConnId uint32, service uint32, destination string, traceParent string) error
 	SendCloseConn(remoteConnId uint32) error
+	SendHello(agentName string, serviceName string, agentVersion string, sessionToken string, allowList string) error
+	SendServiceHealth(healthy bool, reason string) error
 	SendPing() error
+	Close() error
 }
 
 var log = logs.GetLoggerForModule("mess_ovr")
@@ -46,6 +85,7 @@ func NewMessengerOverlay(messenger Messenger) MessengerOverlay {
 		onForward:         nil,
 		onOpenConn:        nil,
 		onCloseConn:       nil,
+		onHello:           nil,
 		onControlConnLost: nil,
 	}
 }
@@ -54,23 +94,34 @@ func (m *messengerOverlay) Start() {
 	m.messenger.SetOnMessageReceived(func(msg interface{}, err error) {
 		if err != nil {
 			log.Errorf("Control connection has failed to receive a message. Executing onControlConnLost. Cause: %s", err)
-			m.onControlConnLost(err)
+			m.controlConnLost(err)
 			return
 		}
 		parsedMessage, ok := msg.(*message)
 		if ok != true {
 			log.Errorf("Control connection message could not be parsed. Executing onControlConnLost. Cause is unknown")
-			m.onControlConnLost(nil)
+			m.controlConnLost(nil)
 		}
 		switch parsedMessage.Type {
 		case Forward:
 			m.onForward(parsedMessage.RemoteConnId, parsedMessage.Service, parsedMessage.Payload, err)
 		case OpenConnection:
-			m.onOpenConn(parsedMessage.RemoteConnId, parsedMessage.Service, err)
+			m.onOpenConn(parsedMessage.RemoteConnId, parsedMessage.Service, parsedMessage.Destination, parsedMessage.TraceParent, err)
 		case CloseConnection:
 			m.onCloseConn(parsedMessage.RemoteConnId, err)
+		case Hello:
+			if m.onHello != nil {
+				m.onHello(parsedMessage.AgentName, parsedMessage.ServiceName, parsedMessage.AgentVersion, parsedMessage.SessionToken, parsedMessage.AllowList, err)
+			}
 		case Ping:
-			log.Info("Ping message has been received")
+			log.Debug("Ping message has been received. Answering with a pong")
+			m.sendPong(parsedMessage.Seq, parsedMessage.Timestamp)
+		case Pong:
+			m.handlePong(parsedMessage.Seq, parsedMessage.Timestamp)
+		case ServiceHealth:
+			if m.onServiceHealth != nil {
+				m.onServiceHealth(parsedMessage.Healthy, parsedMessage.Reason, err)
+			}
 		}
 	}, func() interface{} {
 		return &message{}
@@ -82,7 +133,7 @@ func (m *messengerOverlay) SetOnForwardListener(onForward func(remoteConnId uint
 	m.onForward = onForward
 }
 
-func (m *messengerOverlay) SetOnOpenConnectionListener(onOpenConn func(remoteConnId uint32, service uint32, err error)) {
+func (m *messengerOverlay) SetOnOpenConnectionListener(onOpenConn func(remoteConnId uint32, service uint32, destination string, traceParent string, err error)) {
 	m.onOpenConn = onOpenConn
 }
 
@@ -90,10 +141,42 @@ func (m *messengerOverlay) SetOnCloseConnectionListener(onCloseConn func(remoteC
 	m.onCloseConn = onCloseConn
 }
 
+func (m *messengerOverlay) SetOnHelloListener(onHello func(agentName string, serviceName string, agentVersion string, sessionToken string, allowList string, err error)) {
+	m.onHello = onHello
+}
+
 func (m *messengerOverlay) SetOnControlConnectionLostListener(onControlConnLost func(err error)) {
 	m.onControlConnLost = onControlConnLost
 }
 
+func (m *messengerOverlay) SetOnPongListener(onPong func(rtt time.Duration, stats RTTStats)) {
+	m.onPong = onPong
+}
+
+// SetOnServiceHealthListener sets the listener of the health the agent reports for its local target. Peers that
+// do not know the message ignore it.
+func (m *messengerOverlay) SetOnServiceHealthListener(onServiceHealth func(healthy bool, reason string, err error)) {
+	m.onServiceHealth = onServiceHealth
+}
+
+// SetMaxMissedPongs sets how many pings in a row may go unanswered before SendPing declares the peer dead.
+// Zero disables the check. Detection only starts after the first pong, so peers that do not answer pings at
+// all are left to the messenger timeout.
+func (m *messengerOverlay) SetMaxMissedPongs(maxMissedPongs int) {
+	m.maxMissedPongs = maxMissedPongs
+}
+
+// controlConnLost runs onControlConnLost once, however many of the failing sends and the reader notice the loss.
+func (m *messengerOverlay) controlConnLost(err error) {
+	m.controlConnLostOnce.Do(func() {
+		m.onControlConnLost(err)
+	})
+}
+
+func (m *messengerOverlay) GetRTTStats() RTTStats {
+	return m.rtt.get()
+}
+
 func (m *messengerOverlay) SendForward(remoteConnId uint32, service uint32, payload []byte) error {
 	err := m.messenger.Send(&message{
 		Type:         Forward,
@@ -102,21 +185,23 @@ func (m *messengerOverlay) SendForward(remoteConnId uint32, service uint32, payl
 		Payload:      payload,
 	})
 	if err != nil {
-		log.Errorf("Could not send a forward message. Executing onControlConnLost. Cause: %s", err)
-		m.onControlConnLost(err)
+		log.With(logs.FieldConnId, remoteConnId).Errorf("Could not send a forward message. Executing onControlConnLost. Cause: %s", err)
+		m.controlConnLost(err)
 	}
 	return err
 }
 
-func (m *messengerOverlay) SendOpenConn(remoteConnId uint32, service uint32) error {
+func (m *messengerOverlay) SendOpenConn(remoteConnId uint32, service uint32, destination string, traceParent string) error {
 	err := m.messenger.Send(&message{
 		Type:         OpenConnection,
 		RemoteConnId: remoteConnId,
 		Service:      service,
+		Destination:  destination,
+		TraceParent:  traceParent,
 	})
 	if err != nil {
-		log.Errorf("Could not send a open conn message. Executing onControlConnLost. Cause: %s", err)
-		m.onControlConnLost(err)
+		log.With(logs.FieldConnId, remoteConnId).Errorf("Could not send a open conn message. Executing onControlConnLost. Cause: %s", err)
+		m.controlConnLost(err)
 	}
 	return err
 }
@@ -127,19 +212,96 @@ func (m *messengerOverlay) SendCloseConn(remoteConnId uint32) error {
 		RemoteConnId: remoteConnId,
 	})
 	if err != nil {
-		log.Errorf("Could not send a close conn message. Executing onControlConnLost. Cause: %s", err)
-		m.onControlConnLost(err)
+		log.With(logs.FieldConnId, remoteConnId).Errorf("Could not send a close conn message. Executing onControlConnLost. Cause: %s", err)
+		m.controlConnLost(err)
 	}
 	return err
 }
 
+func (m *messengerOverlay) SendHello(agentName string, serviceName string, agentVersion string, sessionToken string, allowList string) error {
+	err := m.messenger.Send(&message{
+		Type:         Hello,
+		AgentName:    agentName,
+		ServiceName:  serviceName,
+		AgentVersion: agentVersion,
+		SessionToken: sessionToken,
+		AllowList:    allowList,
+	})
+	if err != nil {
+		log.Errorf("Could not send a hello message. Executing onControlConnLost. Cause: %s", err)
+		m.controlConnLost(err)
+	}
+	return err
+}
+
+// SendServiceHealth reports whether the local target of the agent is healthy and, if not, why.
+func (m *messengerOverlay) SendServiceHealth(healthy bool, reason string) error {
+	err := m.messenger.Send(&message{
+		Type:    ServiceHealth,
+		Healthy: healthy,
+		Reason:  reason,
+	})
+	if err != nil {
+		log.Errorf("Could not send a service health message. Executing onControlConnLost. Cause: %s", err)
+		m.controlConnLost(err)
+	}
+	return err
+}
+
+// Close closes the control connection. The receiving side notices and runs onControlConnLost.
+func (m *messengerOverlay) Close() error {
+	return m.messenger.Close()
+}
+
 func (m *messengerOverlay) SendPing() error {
+	m.pingMutex.Lock()
+	missed := m.pingSeq - m.lastPongSeq
+	dead := m.pongSeen && m.maxMissedPongs > 0 && missed >= uint64(m.maxMissedPongs)
+	m.pingSeq++
+	seq := m.pingSeq
+	m.pingMutex.Unlock()
+	if dead {
+		log.Errorf("The peer has not answered the last %d pings. Closing the control connection", missed)
+		m.messenger.Close()
+		m.controlConnLost(ErrPeerDead)
+		return ErrPeerDead
+	}
 	err := m.messenger.Send(&message{
-		Type: Ping,
+		Type:      Ping,
+		Seq:       seq,
+		Timestamp: time.Now().UnixNano(),
 	})
 	if err != nil {
 		log.Errorf("Could not send a ping message. Executing onControlConnLost. Cause: %s", err)
-		m.onControlConnLost(err)
+		m.controlConnLost(err)
 	}
 	return err
 }
+
+func (m *messengerOverlay) sendPong(seq uint64, timestamp int64) {
+	err := m.messenger.Send(&message{
+		Type:      Pong,
+		Seq:       seq,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		log.Errorf("Could not send a pong message. Executing onControlConnLost. Cause: %s", err)
+		m.controlConnLost(err)
+	}
+}
+
+func (m *messengerOverlay) handlePong(seq uint64, timestamp int64) {
+	rtt := time.Since(time.Unix(0, timestamp))
+	m.pingMutex.Lock()
+	if seq > m.lastPongSeq {
+		m.lastPongSeq = seq
+	}
+	m.pongSeen = true
+	m.pingMutex.Unlock()
+	stats := m.rtt.add(rtt)
+	log.Debugf("Pong %d has been received. RTT: %s (min: %s avg: %s max: %s jitter: %s)",
+		seq, rtt, stats.Min, stats.Avg, stats.Max, stats.Jitter)
+	if m.onPong != nil {
+		m.onPong(rtt, stats)
+	}
+}
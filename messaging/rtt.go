@@ -0,0 +1,58 @@
+package messaging
+
+import (
+	"sync"
+	"time"
+)
+
+// RTTStats summarises the round-trip times measured with ping/pong on a control connection.
+// Jitter is the smoothed mean deviation between consecutive samples, as in RFC 3550.
+type RTTStats struct {
+	Samples uint64
+	Last    time.Duration
+	Min     time.Duration
+	Avg     time.Duration
+	Max     time.Duration
+	Jitter  time.Duration
+	// LastAt is when the last pong arrived.
+	LastAt time.Time
+}
+
+type rttTracker struct {
+	mutex sync.Mutex
+	stats RTTStats
+	total time.Duration
+}
+
+func (t *rttTracker) add(rtt time.Duration) RTTStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := &t.stats
+	if s.Samples == 0 {
+		s.Min, s.Max = rtt, rtt
+	} else {
+		delta := rtt - s.Last
+		if delta < 0 {
+			delta = -delta
+		}
+		s.Jitter += (delta - s.Jitter) / 16
+		if rtt < s.Min {
+			s.Min = rtt
+		}
+		if rtt > s.Max {
+			s.Max = rtt
+		}
+	}
+	s.Samples++
+	s.Last = rtt
+	s.LastAt = time.Now()
+	t.total += rtt
+	s.Avg = t.total / time.Duration(s.Samples)
+	return *s
+}
+
+func (t *rttTracker) get() RTTStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stats
+}
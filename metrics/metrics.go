@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family that can render itself in the Prometheus text exposition format.
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registry      []collector
+	registryMutex sync.Mutex
+)
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, c)
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMutex.Lock()
+		collectors := append([]collector(nil), registry...)
+		registryMutex.Unlock()
+		for _, c := range collectors {
+			c.write(w)
+		}
+	})
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  sync.Mutex
+}
+
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+// labelString renders the label set of key, with an optional extra label (e.g. a histogram bucket bound).
+func (f *family) labelString(key string, extraName string, extraValue string) string {
+	var values []string
+	if len(f.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	var parts []string
+	for i, name := range f.labels {
+		parts = append(parts, name+"=\""+escapeLabelValue(values[i])+"\"")
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+"=\""+extraValue+"\"")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValueVec is a counter or gauge partitioned by labels.
+type ValueVec struct {
+	family
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *ValueVec {
+	return newValueVec("counter", name, help, labels)
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *ValueVec {
+	return newValueVec("gauge", name, help, labels)
+}
+
+func newValueVec(kind string, name string, help string, labels []string) *ValueVec {
+	v := &ValueVec{
+		family: family{name: name, help: help, kind: kind, labels: labels},
+		values: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		v.values[""] = 0
+	}
+	register(v)
+	return v
+}
+
+func (v *ValueVec) Add(value float64, labelValues ...string) {
+	key := v.key(labelValues)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[key] += value
+}
+
+func (v *ValueVec) Set(value float64, labelValues ...string) {
+	key := v.key(labelValues)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[key] = value
+}
+
+// Delete removes the series of a label set, e.g. once what it describes is gone.
+func (v *ValueVec) Delete(labelValues ...string) {
+	key := v.key(labelValues)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.values, key)
+}
+
+func (v *ValueVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *ValueVec) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Samples returns the current value of every label set.
+func (v *ValueVec) Samples() []Sample {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	samples := make([]Sample, 0, len(v.values))
+	for _, key := range sortedKeys(v.values) {
+		var labelValues []string
+		if len(v.labels) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		samples = append(samples, Sample{LabelValues: labelValues, Value: v.values[key]})
+	}
+	return samples
+}
+
+func (v *ValueVec) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(key, "", ""), formatValue(v.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec counts observations into cumulative buckets, partitioned by labels.
+type HistogramVec struct {
+	family
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	v := h.values[key]
+	if v == nil {
+		v = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatValue(bound)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key, "", ""), formatValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key, "", ""), v.count)
+	}
+}
+
+// LatencyBuckets suit connection setup times, from a LAN round trip up to a slow dial.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
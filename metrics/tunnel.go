@@ -0,0 +1,37 @@
+package metrics
+
+// Metrics recorded by the server, the agent and their connections. Both roles use the same names; the role
+// is told apart by the scrape target.
+var (
+	ConnectionsActive = NewGaugeVec("pp_connections_active",
+		"Tunneled connections currently proxied.", "service", "agent")
+	ConnectionsTotal = NewCounterVec("pp_connections_total",
+		"Tunneled connections proxied since start.", "service", "agent")
+	BytesTotal = NewCounterVec("pp_bytes_total",
+		"Bytes proxied through tunneled connections. \"in\" flows from the client towards the local target, \"out\" back.", "direction", "service", "agent")
+	ConnectionOpenSeconds = NewHistogramVec("pp_connection_open_seconds",
+		"Time from accepting (server) or being asked to open (agent) a connection until it is proxied.", LatencyBuckets, "service", "agent")
+	OpenFailuresTotal = NewCounterVec("pp_open_failures_total",
+		"Tunneled connections that could not be opened, by reason.", "reason")
+	ControlReconnectsTotal = NewCounterVec("pp_control_reconnects_total",
+		"Control connections established after the first one. On the server, only those of agents that connected before, as told by their session or identity.")
+	SessionResumesTotal = NewCounterVec("pp_session_resumes_total",
+		"Agents that reconnected in time to get their connections re-attached.")
+	StreamsShedTotal = NewCounterVec("pp_streams_shed_total",
+		"Connections forwarded over the control connection that were closed because their local target did not keep up, by the queue that overflowed.", "reason")
+	RelayedConnectionsTotal = NewCounterVec("pp_relayed_connections_total",
+		"Connections relayed to another node of the cluster, by service.", "service")
+	TargetHealthy = NewGaugeVec("pp_target_healthy",
+		"Whether the local target of an agent passed its health probes (1) or not (0), as last reported.", "service", "agent")
+	TLSHandshakeFailuresTotal = NewCounterVec("pp_tls_handshake_failures_total",
+		"Failed TLS handshakes, by the side of the handshake this process was on.", "side")
+	ControlRTTSeconds = NewHistogramVec("pp_control_rtt_seconds",
+		"Round-trip times of control connection pings.", LatencyBuckets, "agent")
+	ControlRTTJitterSeconds = NewGaugeVec("pp_control_rtt_jitter_seconds",
+		"Smoothed jitter of control connection ping round-trip times.", "agent")
+)
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
+	"os"
 	"project-proxy/messaging"
 	"time"
 	"project-proxy/server"
@@ -9,67 +12,362 @@ import (
 	"project-proxy/logs"
 	"project-proxy/connectivity"
 	"project-proxy/certs"
+	"project-proxy/admin"
+	"project-proxy/metrics"
+	"project-proxy/tracing"
+	"project-proxy/hooks"
+	"project-proxy/health"
+	"errors"
+	"sync/atomic"
+	"strings"
+	"project-proxy/cluster"
+	"context"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	controlConnNetworkType := flag.String("control-conn-net-type", "tcp", "The network type of the control connection")
+	controlConnNetworkType := flag.String("control-conn-net-type", "tcp", "The network type of the control connection (tcp, ws or wss)")
 	controlConnAddress := flag.String("control-conn-addr", ":9001", "The ip_addr:port combination of the control connection")
-	controlConnRestartInterval := flag.Int("control-conn-reset-interval", 1000, "Waiting time in ms before attempting to restart the control connection")
+	controlConnRestartInterval := flag.Int("control-conn-reset-interval", 1000, "Waiting time in ms before accepting control connections again after accepting one failed")
 	controlConnPingInterval := flag.Int("control-conn-ping-interval", 30000, "Waiting time in ms between pings to keep the control connection alive. Setting this to zero disables pinging")
 	controlConnPingTimeout := flag.Int("control-conn-ping-timeout", 45000, "Max waiting time in ms for a ping message before the control connection gets closed and re-established. Setting this to zero disables timeout")
-	incomingConnNetworkType := flag.String("incoming-conn-net-type", "tcp", "The network type of the incoming client connections")
-	incomingConnAddress := flag.String("incoming-conn-addr", ":80", "The ip_addr:port combination of the incoming client connections")
-	transferConnNetworkType := flag.String("transfer-conn-net-type", "tcp", "The network type of the transfer connections")
+	controlConnMaxMissedPongs := flag.Int("control-conn-max-missed-pongs", 3, "Number of pings in a row left unanswered after which the peer is considered dead and the control connection gets re-established. Setting this to zero disables the check")
+	sessionResumeTimeout := flag.Int("session-resume-timeout", 30000, "Max waiting time in ms for an agent whose control connection was lost to reconnect and get its proxied connections re-attached. Setting this to zero closes them right away")
+	connIdleTimeout := flag.Int("conn-idle-timeout", 0, "Time in ms after which a tunneled connection without traffic in either direction is closed. Setting this to zero disables the timeout")
+	connMaxLifetime := flag.Int("conn-max-lifetime", 0, "Time in ms after which a tunneled connection is closed regardless of its traffic. Setting this to zero disables the limit")
+	serviceIdleTimeouts := flag.String("service-conn-idle-timeouts", "", "Comma separated service=ms pairs overriding conn-idle-timeout for the connections of single services, e.g. ssh=3600000,web=60000")
+	serviceMaxLifetimes := flag.String("service-conn-max-lifetimes", "", "Comma separated service=ms pairs overriding conn-max-lifetime for the connections of single services")
+	incomingConnNetworkType := flag.String("incoming-conn-net-type", "tcp", "The network type of the incoming client connections (tcp, unix or unixpacket)")
+	incomingConnAddress := flag.String("incoming-conn-addr", ":80", "The ip_addr:port combination (or the unix socket path, '@name' for the abstract namespace) of the incoming client connections. Empty disables the public port, leaving the service reachable through client-conn-addr only")
+	incomingConnService := flag.String("incoming-conn-service", "", "The service that connections to incoming-conn-addr and socks-conn-addr are tunneled to. Empty spreads them across the connected agents as long as these serve the same service and refuses them otherwise. SOCKS5 connections only go to agents whose lan-allow permits the destination")
+	balancePolicy := flag.String("balance-policy", "round-robin", "How new connections are spread across the agents serving the same service: round-robin, least-connections or weighted")
+	agentWeights := flag.String("agent-weights", "", "Comma separated agent=weight pairs used by the weighted balance-policy, e.g. nas1=3,nas2=1. Agents not listed weigh 1")
+	incomingConnUnixOwner := flag.String("incoming-conn-unix-owner", "", "The user[:group] owning the incoming unix socket. Empty leaves the owner unchanged")
+	incomingConnUnixMode := flag.String("incoming-conn-unix-mode", "", "The octal file mode (e.g. 0660) of the incoming unix socket. Empty leaves the mode unchanged")
+	controlConnWsPath := flag.String("control-conn-ws-path", "/control", "The HTTP path of the control connection when using the ws or wss network type")
+	socksConnNetworkType := flag.String("socks-conn-net-type", "tcp", "The network type of the SOCKS5 front-end")
+	socksConnAddress := flag.String("socks-conn-addr", "", "The ip_addr:port combination of the SOCKS5 front-end reaching hosts inside the agent's LAN (see the agent's lan-allow). The SOCKS5 username picks the agent by name; without one, a connection is refused if several agents allow its destination. Empty disables it")
+	socksPassword := flag.String("socks-password", "", "The password SOCKS5 clients must authenticate with, along with the name of an agent as username. Empty lets clients connect without authentication")
+	clientConnNetworkType := flag.String("client-conn-net-type", "tcp", "The network type of the client connections (tcp, ws or wss)")
+	clientConnAddress := flag.String("client-conn-addr", "", "The ip_addr:port combination where clients authenticated with a certificate request the agent service. Empty disables it")
+	clientConnWsPath := flag.String("client-conn-ws-path", "/client", "The HTTP path of the client connections when using the ws or wss network type")
+	transferConnNetworkType := flag.String("transfer-conn-net-type", "tcp", "The network type of the transfer connections (tcp, ws or wss)")
 	transferConnAddress := flag.String("transfer-conn-addr", ":8888", "The ip_addr:port combination of the transfer connections")
+	transferConnWsPath := flag.String("transfer-conn-ws-path", "/transfer", "The HTTP path of the transfer connections when using the ws or wss network type. Control and transfer connections can share an address if their paths differ")
 	bufferSize := flag.Uint64("buffer-size", 512, "Size of the buffer (in KB) used to read from and write to remote connections")
+	adminAddress := flag.String("admin-addr", "", "The ip_addr:port combination serving the JSON admin API at /api/. Empty disables it")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin API")
+	adminUseTLS := flag.Bool("admin-tls", false, "If true, serves the admin API over TLS and requires a client certificate signed by the admin CA")
+	adminCAFile := flag.String("admin-ca-file", "", "PEM file with the CA that signs the client certificates of the admin API. Required by admin-tls. It must not be the root certificate of agents")
+	metricsAddress := flag.String("metrics-addr", "", "The ip_addr:port combination serving Prometheus metrics at /metrics. Empty disables it")
+	healthAddress := flag.String("health-addr", "", "The ip_addr:port combination serving liveness at /healthz and readiness at /readyz. Ready means the control connection listener is bound and health-min-agents agents are connected with their listeners bound. Empty disables it")
+	healthMinAgents := flag.Int("health-min-agents", 1, "Number of connected agents required for readiness")
+	traceExport := flag.String("trace-export", "", "Where connection setup spans are exported: an OTLP/HTTP traces URL (e.g. http://127.0.0.1:4318/v1/traces) or a file path. Empty disables tracing")
 	logLevel := flag.Int("log-level", 4, "Log levels: 0 CRITICAL, 1 ERROR, 2 WARNING, 3 NOTICE, 4 INFO, 5 DEBUG")
-	usePlainTcpTransferConns := flag.Bool("tcp-transfer-conns", false, "If true, uses plain TCP (instead of TLS) for transfer connections. This is usually a bad idea")
+	logModuleLevels := flag.String("log-module-levels", "", "Comma separated module=level pairs overriding log-level for single modules, e.g. server=5,proxy=2. Modules: main, server, agent, client, mess, mess_ovr, proxy, admin, hooks, health, cluster, logs. On unix SIGUSR1 makes the default level more verbose and SIGUSR2 restores the startup levels")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logSink := flag.String("log-sink", "stdout", "Where the logs are written: stdout, stderr, file, syslog or journald")
+	logFile := flag.String("log-file", "", "Path of the log file used by the file log sink")
+	logFileMaxSize := flag.Int("log-file-max-size", 100, "Size in MB after which the log file is rotated. Setting this to zero disables rotation")
+	logFileMaxBackups := flag.Int("log-file-max-backups", 5, "Number of rotated log files kept")
+	accessLogPath := flag.String("access-log", "", "Path of the access log with one line per closed connection, '-' for stdout. Empty disables the access log. Rotated like the log file")
+	accessLogFormat := flag.String("access-log-format", "common", "Access log format: common or json")
+	hooksFile := flag.String("hooks-file", "", "Path of a JSON file with an array of event hooks, each with events, command (and args) or url (and headers), timeout, retries and retryDelay")
+	hookCommand := flag.String("hook-exec", "", "Executable run for every event in hook-events with the event as JSON on stdin. Empty disables it")
+	hookURL := flag.String("hook-url", "", "URL every event in hook-events is POSTed to as JSON. Empty disables it")
+	hookEvents := flag.String("hook-events", "", "Comma separated event types passed to hook-exec and hook-url: agent_connected, agent_disconnected, service_up, service_down, target_unhealthy, target_healthy, connection_opened, connection_closed, certificate_expiring. Empty means all")
+	hookTimeout := flag.Int("hook-timeout", 10000, "Max time in ms a hook-exec or hook-url run may take before it is considered failed")
+	hookRetries := flag.Int("hook-retries", 3, "Number of times a failed hook-exec or hook-url run is retried")
+	certExpiryWarning := flag.Int("cert-expiry-warning", 30, "Number of days before the expiry of the server's or an agent's certificate from which a certificate_expiring event is published. Setting this to zero disables the check")
+	clusterAddress := flag.String("cluster-addr", "", "The ip_addr:port combination other cluster nodes reach this server at, to gossip connected agents and relay connections no local agent serves. Empty disables clustering")
+	clusterListenAddress := flag.String("cluster-listen-addr", "", "The ip_addr:port combination the cluster connections are accepted at if it differs from cluster-addr")
+	clusterNodeName := flag.String("cluster-node-name", "", "The unique name of this server in the cluster, which its cluster certificate must carry as common name or DNS name. Empty uses the common name of the cluster certificate")
+	clusterCertFile := flag.String("cluster-cert-file", "", "PEM file with the certificate this server proves to be a cluster node with. Required for clustering")
+	clusterKeyFile := flag.String("cluster-key-file", "", "PEM file with the private key of the cluster certificate")
+	clusterCAFile := flag.String("cluster-ca-file", "", "PEM file with the CA that signed the cluster certificates of all nodes. It must not be the root certificate of agents and clients. Required for clustering")
+	clusterPeers := flag.String("cluster-peers", "", "Comma separated cluster-addr of other nodes to join the cluster through")
+	clusterGossipInterval := flag.Int("cluster-gossip-interval", 1000, "Waiting time in ms between exchanging the connected agents with other cluster nodes")
+	clusterDeadAfter := flag.Int("cluster-dead-after", 5000, "Time in ms after which a cluster node not heard of is considered down and no more connections are relayed to it")
+	dialTimeout := flag.Int("dial-timeout", 30000, "Max time in ms to establish a connection before the attempt is given up. Setting this to zero disables the timeout")
+	handshakeTimeout := flag.Int("handshake-timeout", 10000, "Max time in ms for the TLS and WebSocket handshakes of a connection, both connecting and accepting. Setting this to zero disables the timeout")
+	tcpKeepAlive := flag.Int("tcp-keepalive-interval", 0, "Interval in ms of TCP keep-alive probes. Zero uses the system default (15000), a negative value disables them")
+	usePlainTcpTransferConns := flag.Bool("tcp-transfer-conns", false, "If true, uses plain TCP (instead of TLS) for tcp control and transfer connections. This is usually a bad idea")
 
 	envy.Parse("APP")
 	flag.Parse()
 
-	logs.Init(*logLevel)
+	err := logs.InitWithOptions(logs.Options{
+		Level:          *logLevel,
+		ModuleLevels:   *logModuleLevels,
+		Format:         *logFormat,
+		Sink:           *logSink,
+		File:           *logFile,
+		FileMaxSizeMB:  *logFileMaxSize,
+		FileMaxBackups: *logFileMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up logging. Cause: %s\n", err)
+		os.Exit(1)
+	}
+	connOptions := connectivity.ConnOptions{
+		DialTimeout:      time.Duration(*dialTimeout) * time.Millisecond,
+		HandshakeTimeout: time.Duration(*handshakeTimeout) * time.Millisecond,
+		KeepAlive:        time.Duration(*tcpKeepAlive) * time.Millisecond,
+	}
+	logs.HandleLevelSignals()
 	log := logs.GetLoggerForModule("main")
 
-	var controlCf connectivity.ConnFactory
-	var transferCf connectivity.ConnFactory
+	if *traceExport != "" {
+		exporter, err := tracing.NewExporter(*traceExport)
+		if err != nil {
+			log.Fatalf("Could not set up the trace exporter. Cause: %s", err)
+		}
+		tracing.SetExporter(exporter, "project-proxy-server")
+		log.Infof("Exporting traces to %s", *traceExport)
+	}
+
+	if *metricsAddress != "" {
+		err := connectivity.HandleHTTP(nil, *metricsAddress, connOptions, "/metrics", metrics.Handler())
+		if err != nil {
+			log.Fatalf("Could not serve metrics. Cause: %s", err)
+		}
+		log.Infof("Serving metrics at %s/metrics", *metricsAddress)
+	}
+
+	tlsConfig := connectivity.NewTLSConfig(certs.RootCertificate, certs.ServerPrivateKey, certs.ServerCertificate, true)
 	if *usePlainTcpTransferConns {
-		controlCf = connectivity.NewTCPConnectionFactory(*controlConnNetworkType, *controlConnAddress)
-		transferCf = connectivity.NewTCPConnectionFactory(*transferConnNetworkType, *transferConnAddress)
 		log.Warning("Plain TCP is used for transfer connections. Please check if this is as intended")
+	}
+	controlCf := connectivity.NewTunnelConnectionFactory(tlsConfig, *usePlainTcpTransferConns,
+		*controlConnNetworkType, *controlConnAddress, *controlConnWsPath)
+	transferCf := connectivity.NewTunnelConnectionFactory(tlsConfig, *usePlainTcpTransferConns,
+		*transferConnNetworkType, *transferConnAddress, *transferConnWsPath)
+	controlCf.SetOptions(connOptions)
+	transferCf.SetOptions(connOptions)
+
+	var incomingCf connectivity.ConnFactory
+	if *incomingConnAddress == "" {
+		incomingCf = nil
+	} else if connectivity.IsUnixNetworkType(*incomingConnNetworkType) {
+		mode, err := connectivity.ParseSocketMode(*incomingConnUnixMode)
+		if err != nil {
+			log.Fatalf("Could not parse the incoming unix socket mode. Cause: %s", err)
+		}
+		incomingCf = connectivity.NewUnixConnectionFactory(*incomingConnNetworkType, *incomingConnAddress, *incomingConnUnixOwner, mode)
 	} else {
-		controlCf = connectivity.NewTLSConnectionFactory(certs.RootCertificate, certs.ServerPrivateKey,
-			certs.ServerCertificate, true, *controlConnNetworkType, *controlConnAddress)
-		transferCf = connectivity.NewTLSConnectionFactory(certs.RootCertificate, certs.ServerPrivateKey,
-			certs.ServerCertificate, true, *transferConnNetworkType, *transferConnAddress)
+		incomingCf = connectivity.NewTCPConnectionFactory(*incomingConnNetworkType, *incomingConnAddress)
+	}
+	if incomingCf != nil {
+		incomingCf.SetOptions(connOptions)
 	}
 
-	incomingCf := connectivity.NewTCPConnectionFactory(*incomingConnNetworkType, *incomingConnAddress)
+	var accessLog logs.AccessLog
+	if *accessLogPath != "" {
+		accessLog, err = logs.OpenAccessLog(*accessLogFormat, *accessLogPath, *logFileMaxSize, *logFileMaxBackups)
+		if err != nil {
+			log.Fatalf("Could not open the access log. Cause: %s", err)
+		}
+		log.Infof("Writing the access log to %s", *accessLogPath)
+	}
+
+	var eventHooks []hooks.Hook
+	if *hooksFile != "" {
+		eventHooks, err = hooks.LoadHooks(*hooksFile)
+		if err != nil {
+			log.Fatalf("Could not load the event hooks. Cause: %s", err)
+		}
+	}
+	hookTimeoutDuration := hooks.Duration(time.Duration(*hookTimeout) * time.Millisecond)
+	if *hookCommand != "" {
+		eventHooks = append(eventHooks, hooks.Hook{Command: *hookCommand, Events: hooks.ParseEventTypes(*hookEvents),
+			Retries: *hookRetries, Timeout: hookTimeoutDuration})
+	}
+	if *hookURL != "" {
+		eventHooks = append(eventHooks, hooks.Hook{URL: *hookURL, Events: hooks.ParseEventTypes(*hookEvents),
+			Retries: *hookRetries, Timeout: hookTimeoutDuration})
+	}
+	err = hooks.Start(eventHooks)
+	if err != nil {
+		log.Fatalf("Could not start the event hooks. Cause: %s", err)
+	}
+
+	registry := server.NewRegistry()
+	var sessions server.Sessions
+	if *sessionResumeTimeout > 0 {
+		sessions = server.NewSessions(time.Duration(*sessionResumeTimeout) * time.Millisecond)
+	}
+	connLimits := server.ConnLimits{
+		IdleTimeout: time.Duration(*connIdleTimeout) * time.Millisecond,
+		MaxLifetime: time.Duration(*connMaxLifetime) * time.Millisecond,
+	}
+	connLimits.ServiceIdleTimeouts, err = server.ParseServiceDurations(*serviceIdleTimeouts)
+	if err != nil {
+		log.Fatalf("Could not parse the service idle timeouts. Cause: %s", err)
+	}
+	connLimits.ServiceMaxLifetimes, err = server.ParseServiceDurations(*serviceMaxLifetimes)
+	if err != nil {
+		log.Fatalf("Could not parse the service max lifetimes. Cause: %s", err)
+	}
+	if *certExpiryWarning > 0 {
+		err := server.WatchCertificates(registry, []string{certs.ServerCertificate, certs.RootCertificate},
+			time.Duration(*certExpiryWarning)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("Could not watch the certificates. Cause: %s", err)
+		}
+	}
+	if *adminAddress != "" {
+		var adminTLSConfig *tls.Config
+		if *adminUseTLS {
+			if *adminCAFile == "" {
+				log.Fatalf("Serving the admin API over TLS needs an admin CA")
+			}
+			adminTLSConfig, err = admin.NewTLSConfig(tlsConfig, *adminCAFile, certs.AgentCertificate)
+			if err != nil {
+				log.Fatalf("Could not load the admin CA. Cause: %s", err)
+			}
+		} else if *adminToken == "" {
+			log.Warning("The admin API is served without TLS and without a token. Anyone reaching it can disconnect agents")
+		}
+		err := connectivity.HandleHTTP(adminTLSConfig, *adminAddress, connOptions, "/api/", admin.NewHandler(registry, *adminToken))
+		if err != nil {
+			log.Fatalf("Could not serve the admin API. Cause: %s", err)
+		}
+		log.Infof("Serving the admin API at %s/api/", *adminAddress)
+	}
+
+	var socksCf connectivity.ConnFactory
+	if *socksConnAddress != "" {
+		socksCf = connectivity.NewTCPConnectionFactory(*socksConnNetworkType, *socksConnAddress)
+		socksCf.SetOptions(connOptions)
+	}
+
+	var clientCf connectivity.ConnFactory
+	if *clientConnAddress != "" {
+		clientCf = connectivity.NewTunnelConnectionFactory(tlsConfig, false, *clientConnNetworkType, *clientConnAddress, *clientConnWsPath)
+		clientCf.SetOptions(connOptions)
+	}
+
+	var controlListening int32
+	if *healthAddress != "" {
+		checker := health.NewChecker()
+		checker.AddReadinessCheck("control_listener", func() error {
+			if atomic.LoadInt32(&controlListening) == 0 {
+				return errors.New("not listening for control connections yet")
+			}
+			return nil
+		})
+		checker.AddReadinessCheck("agents", func() error {
+			ready := 0
+			for _, s := range registry.GetServers() {
+				if s.IsListening() {
+					ready++
+				}
+			}
+			if ready < *healthMinAgents {
+				return fmt.Errorf("%d of %d expected agents connected", ready, *healthMinAgents)
+			}
+			return nil
+		})
+		for _, pattern := range []string{"/healthz", "/readyz"} {
+			err := connectivity.HandleHTTP(nil, *healthAddress, connOptions, pattern, checker.Handler())
+			if err != nil {
+				log.Fatalf("Could not serve the health endpoints. Cause: %s", err)
+			}
+		}
+		log.Infof("Serving health endpoints at %s/healthz and %s/readyz", *healthAddress, *healthAddress)
+	}
+
+	// Interrupting the server closes its listeners and ends the accept loop.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Infof("Trying to listen for a type %s control connection at %s", *controlConnNetworkType, *controlConnAddress)
-	ln, err := controlCf.Listen()
+	ln, err := controlCf.ListenContext(ctx)
 	if err != nil {
 		log.Fatalf("Could not listen for control connection. Cause: %s", err)
 	}
+	atomic.StoreInt32(&controlListening, 1)
+
+	weights, err := server.ParseWeights(*agentWeights)
+	if err != nil {
+		log.Fatalf("Could not parse the agent weights. Cause: %s", err)
+	}
+	balancer, err := server.NewBalancer(*balancePolicy, weights)
+	if err != nil {
+		log.Fatalf("Could not set up load balancing. Cause: %s", err)
+	}
+	hub := server.NewHub(registry, incomingCf, transferCf, balancer)
+	hub.SetSocksConnFactory(socksCf)
+	hub.SetSocksPassword(*socksPassword)
+	hub.SetClientConnFactory(clientCf)
+	hub.SetIncomingService(*incomingConnService)
+	err = hub.Listen(ctx)
+	if err != nil {
+		log.Fatalf("Could not listen for remote, transfer, SOCKS5 or client connections. Is an address used already? Cause: %s", err)
+	}
+
+	if *clusterAddress != "" {
+		if *clusterCertFile == "" || *clusterKeyFile == "" || *clusterCAFile == "" {
+			log.Fatalf("Clustering needs a cluster certificate, its key and the cluster CA")
+		}
+		credentials, err := cluster.LoadCredentials(*clusterCertFile, *clusterKeyFile, *clusterCAFile)
+		if err != nil {
+			log.Fatalf("Could not load the cluster credentials. Cause: %s", err)
+		}
+		if credentials.Trusts(certs.AgentCertificate) {
+			log.Fatalf("The cluster CA signed the built-in agent certificate. Use a CA of the cluster's own")
+		}
+		var peers []string
+		for _, peer := range strings.Split(*clusterPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		node := cluster.NewNode(*clusterNodeName, *clusterAddress, peers,
+			time.Duration(*clusterGossipInterval)*time.Millisecond,
+			time.Duration(*clusterDeadAfter)*time.Millisecond,
+			credentials, connOptions, registry, hub)
+		node.SetListenAddress(*clusterListenAddress)
+		err = node.Start(ctx)
+		if err != nil {
+			log.Fatalf("Could not listen for cluster connections. Cause: %s", err)
+		}
+		hub.SetRelay(node)
+	}
+
+	log.Infof("Successfully listening for agents to establish control connections")
 	for {
-		log.Infof("Successfully listening for an agent to establish a control connection")
 		conn, err := ln.Accept()
+		if ctx.Err() != nil {
+			log.Warningf("The server was interrupted. Exiting")
+			return
+		}
 		if err != nil {
 			log.Errorf("Could not accept a control connection. Cause: %s", err)
+			sleepingTime := time.Millisecond * time.Duration(*controlConnRestartInterval)
+			log.Warningf("Waiting for %d ms to allow the next control connection", sleepingTime/time.Millisecond)
+			time.Sleep(sleepingTime)
 			continue
-		} else {
-			log.Infof("Successfully established a control connection with agent addr: %s Starting the server", conn.RemoteAddr())
-			mess := messaging.NewMessenger(conn)
-			mess.SetTimeout(time.Duration(*controlConnPingTimeout) * time.Millisecond)
-			s := server.NewServer(incomingCf, transferCf,
-				time.Duration(*controlConnPingInterval)*time.Millisecond,
-				*bufferSize*1024, messaging.NewMessengerOverlay(mess))
-			s.Start()
-			s.Wait()
-			log.Warningf("The server has finished. This usually means connectivity or agent problems. Allowing another control connection")
 		}
-		sleepingTime := time.Millisecond * time.Duration(*controlConnRestartInterval)
-		log.Warningf("Waiting for %d ms to allow the next control connection", sleepingTime/time.Millisecond)
-		time.Sleep(sleepingTime)
+		log.Infof("Successfully established a control connection with agent addr: %s Starting a server for it", conn.RemoteAddr())
+		mess := messaging.NewMessenger(conn)
+		mess.SetTimeout(time.Duration(*controlConnPingTimeout) * time.Millisecond)
+		overlay := messaging.NewMessengerOverlay(mess)
+		overlay.SetMaxMissedPongs(*controlConnMaxMissedPongs)
+		s := server.NewServer(
+			time.Duration(*controlConnPingInterval)*time.Millisecond,
+			*bufferSize*1024, overlay)
+		s.SetControlConn(conn)
+		s.SetRegistry(registry)
+		s.SetAccessLog(accessLog)
+		s.SetSessions(sessions)
+		s.SetConnLimits(connLimits)
+		s.SetHub(hub)
+		s.Start()
+		go func() {
+			s.Wait()
+			log.Warningf("The server of agent addr: %s has finished. This usually means connectivity or agent problems", conn.RemoteAddr())
+		}()
 	}
 }
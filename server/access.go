@@ -0,0 +1,71 @@
+package server
+
+import (
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+	"time"
+)
+
+// Reasons a tunneled connection was closed, as recorded in the access log.
+const (
+	closeClientEOF    = "client_eof"
+	closeAgentEOF     = "agent_eof"
+	closeError        = "error"
+	closeTimeout      = "timeout"
+	closeAdminKill    = "admin_kill"
+	closeAgentRefused = "agent_refused"
+	closeControlLost  = "control_lost"
+	closeIdle         = "idle_timeout"
+	closeMaxLifetime  = "max_lifetime"
+)
+
+func (s *server) SetAccessLog(accessLog logs.AccessLog) {
+	s.accessLog = accessLog
+}
+
+// proxyCloseReason translates the reason of a proxy between the client (A) and the agent (B).
+func proxyCloseReason(reason connectivity.CloseReason) string {
+	switch reason {
+	case connectivity.CloseEOFA:
+		return closeClientEOF
+	case connectivity.CloseEOFB:
+		return closeAgentEOF
+	case connectivity.CloseTimeout:
+		return closeTimeout
+	case connectivity.CloseStopped:
+		return closeAdminKill
+	case connectivity.CloseIdle:
+		return closeIdle
+	case connectivity.CloseMaxLifetime:
+		return closeMaxLifetime
+	default:
+		return closeError
+	}
+}
+
+// logAccess writes the access log record of a tunnel that has ended and returns its close reason. A reason set
+// on the tunnel beforehand, e.g. by losing the control connection, replaces the error that closing it caused.
+func (s *server) logAccess(id uint32, t *tunnel, reason string, bytesIn uint64, bytesOut uint64) string {
+	s.localConnsMutex.Lock()
+	if t.closeReason != "" && reason == closeError {
+		reason = t.closeReason
+	}
+	s.localConnsMutex.Unlock()
+	if s.accessLog == nil {
+		return reason
+	}
+	serviceName, agentName := s.getIdentity()
+	s.accessLog.Log(logs.AccessRecord{
+		ConnId:        id,
+		ClientAddress: t.conn.RemoteAddr().String(),
+		Agent:         agentName,
+		Service:       serviceName,
+		Destination:   t.destination,
+		Start:         t.accepted,
+		Duration:      time.Since(t.accepted),
+		BytesIn:       bytesIn,
+		BytesOut:      bytesOut,
+		CloseReason:   reason,
+	})
+	return reason
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Load balancing policies spreading new connections across the agents serving the same service.
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceWeighted         = "weighted"
+)
+
+// Balancer picks the agent (server) a new connection goes to.
+type Balancer interface {
+	pick(servers []*server) *server
+}
+
+type roundRobinBalancer struct {
+	next  uint64
+	mutex sync.Mutex
+}
+
+type leastConnectionsBalancer struct {
+	roundRobin roundRobinBalancer
+}
+
+// weightedBalancer is a smooth weighted round robin: every pick raises each agent's current weight by its weight and
+// lowers the picked agent's by the total, so agents are interleaved rather than picked in bursts.
+type weightedBalancer struct {
+	weights map[string]int
+	current map[*server]int
+	mutex   sync.Mutex
+}
+
+// NewBalancer returns a balancer for a policy. weights maps agent names to weights for the weighted policy; agents
+// not listed weigh 1.
+func NewBalancer(policy string, weights map[string]int) (Balancer, error) {
+	switch policy {
+	case BalanceRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalanceLeastConnections:
+		return &leastConnectionsBalancer{}, nil
+	case BalanceWeighted:
+		return &weightedBalancer{
+			weights: weights,
+			current: make(map[*server]int),
+		}, nil
+	}
+	return nil, errors.New("unknown load balancing policy: " + policy)
+}
+
+// ParseWeights parses comma separated agent=weight pairs, e.g. nas1=3,nas2=1.
+func ParseWeights(list string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid agent weight: %s", pair)
+		}
+		weight, err := strconv.Atoi(pair[i+1:])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid agent weight: %s", pair)
+		}
+		weights[pair[:i]] = weight
+	}
+	return weights, nil
+}
+
+func (b *roundRobinBalancer) pick(servers []*server) *server {
+	if len(servers) == 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := servers[b.next%uint64(len(servers))]
+	b.next++
+	return s
+}
+
+func (b *leastConnectionsBalancer) pick(servers []*server) *server {
+	var least []*server
+	leastConns := 0
+	for _, s := range servers {
+		conns := s.countConns()
+		if least == nil || conns < leastConns {
+			least, leastConns = nil, conns
+		}
+		if conns == leastConns {
+			least = append(least, s)
+		}
+	}
+	return b.roundRobin.pick(least)
+}
+
+func (b *weightedBalancer) pick(servers []*server) *server {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	present := make(map[*server]bool, len(servers))
+	var best *server
+	total := 0
+	for _, s := range servers {
+		present[s] = true
+		_, agentName := s.getIdentity()
+		weight := b.weights[agentName]
+		if weight < 1 {
+			weight = 1
+		}
+		total += weight
+		b.current[s] += weight
+		if best == nil || b.current[s] > b.current[best] {
+			best = s
+		}
+	}
+	for s := range b.current {
+		if !present[s] {
+			delete(b.current, s)
+		}
+	}
+	if best != nil {
+		b.current[best] -= total
+	}
+	return best
+}
+
+func (s *server) countConns() int {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	return len(s.localConns)
+}
+
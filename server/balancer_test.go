@@ -0,0 +1,98 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testAgent is an agent serving a connection pool with conns tunneled connections.
+type testAgent struct {
+	name  string
+	conns int
+}
+
+func newTestServers(agents []testAgent) []*server {
+	var servers []*server
+	for _, a := range agents {
+		s := &server{agentName: a.name, localConns: make(map[uint32]*tunnel)}
+		for i := 0; i < a.conns; i++ {
+			s.localConns[uint32(i)] = &tunnel{}
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func TestBalancers(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		weights map[string]int
+		agents  []testAgent
+		picks   string
+	}{
+		{"round robin", BalanceRoundRobin, nil, []testAgent{{"a", 0}, {"b", 0}, {"c", 0}}, "abcabc"},
+		{"round robin of one agent", BalanceRoundRobin, nil, []testAgent{{"a", 0}}, "aaa"},
+		{"least connections", BalanceLeastConnections, nil, []testAgent{{"a", 2}, {"b", 1}, {"c", 3}}, "bbb"},
+		{"least connections ties", BalanceLeastConnections, nil, []testAgent{{"a", 1}, {"b", 2}, {"c", 1}}, "acac"},
+		{"weighted", BalanceWeighted, map[string]int{"a": 3, "b": 1}, []testAgent{{"a", 0}, {"b", 0}}, "aabaaaba"},
+		{"weighted interleaves", BalanceWeighted, map[string]int{"a": 2, "b": 2, "c": 1}, []testAgent{{"a", 0}, {"b", 0}, {"c", 0}}, "abcab"},
+		{"weighted defaults to 1", BalanceWeighted, map[string]int{"a": 0}, []testAgent{{"a", 0}, {"b", 0}}, "abab"},
+	}
+	for _, test := range tests {
+		balancer, err := NewBalancer(test.policy, test.weights)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		servers := newTestServers(test.agents)
+		var picks strings.Builder
+		for range test.picks {
+			picks.WriteString(balancer.pick(servers).agentName)
+		}
+		if picks.String() != test.picks {
+			t.Errorf("%s: picked %s, expected %s", test.name, picks.String(), test.picks)
+		}
+	}
+}
+
+func TestBalancersPickNothingFromEmptyPool(t *testing.T) {
+	for _, policy := range []string{BalanceRoundRobin, BalanceLeastConnections, BalanceWeighted} {
+		balancer, _ := NewBalancer(policy, nil)
+		if s := balancer.pick(nil); s != nil {
+			t.Errorf("%s picked an agent from an empty pool", policy)
+		}
+	}
+}
+
+func TestNewBalancerRejectsUnknownPolicy(t *testing.T) {
+	if _, err := NewBalancer("random", nil); err == nil {
+		t.Fatalf("An unknown policy was accepted")
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	tests := []struct {
+		list    string
+		weights map[string]int
+		fails   bool
+	}{
+		{"", map[string]int{}, false},
+		{"nas1=3,nas2=1", map[string]int{"nas1": 3, "nas2": 1}, false},
+		{" nas1=3 , ,nas2=1 ", map[string]int{"nas1": 3, "nas2": 1}, false},
+		{"nas1", nil, true},
+		{"nas1=0", nil, true},
+		{"nas1=-2", nil, true},
+		{"nas1=x", nil, true},
+	}
+	for _, test := range tests {
+		weights, err := ParseWeights(test.list)
+		if (err != nil) != test.fails {
+			t.Errorf("%q: unexpected error: %v", test.list, err)
+			continue
+		}
+		if !test.fails && !reflect.DeepEqual(weights, test.weights) {
+			t.Errorf("%q: parsed %v, expected %v", test.list, weights, test.weights)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+	"project-proxy/events"
+)
+
+const (
+	certificateCheckInterval = time.Hour
+	// certificateWarningRepeat is how often the same expiring certificate is reported again.
+	certificateWarningRepeat = 24 * time.Hour
+)
+
+// WatchCertificates periodically publishes a CertificateExpiring event for each of the PEM certificates (the server's
+// own) and for each certificate a connected agent authenticated with that expires within warnBefore.
+func WatchCertificates(registry Registry, certsPEM []string, warnBefore time.Duration) error {
+	var own []*x509.Certificate
+	for _, certPEM := range certsPEM {
+		cert, err := parseCertificate(certPEM)
+		if err != nil {
+			return err
+		}
+		own = append(own, cert)
+	}
+	warned := make(map[string]time.Time)
+	warn := func(cert *x509.Certificate, agentName string, now time.Time) {
+		if cert.NotAfter.Sub(now) > warnBefore {
+			return
+		}
+		key := cert.Subject.String() + "/" + cert.SerialNumber.String()
+		if last, ok := warned[key]; ok && now.Sub(last) < certificateWarningRepeat {
+			return
+		}
+		warned[key] = now
+		notAfter := cert.NotAfter
+		message := fmt.Sprintf("expires in %s", cert.NotAfter.Sub(now).Round(time.Minute))
+		if !now.Before(cert.NotAfter) {
+			message = "expired"
+		}
+		log.Warningf("Certificate %s %s (at %s)", cert.Subject, message, cert.NotAfter.Format(time.RFC3339))
+		events.Publish(events.Event{Type: events.CertificateExpiring, Agent: agentName, Certificate: cert.Subject.String(),
+			ExpiresAt: &notAfter, Message: message})
+	}
+	go func() {
+		for {
+			now := time.Now()
+			for _, cert := range own {
+				warn(cert, "", now)
+			}
+			for _, s := range registry.GetServers() {
+				srv, ok := s.(*server)
+				if !ok || srv.controlConn == nil {
+					continue
+				}
+				if cert := peerCertificate(srv.controlConn); cert != nil {
+					_, agentName := srv.getIdentity()
+					warn(cert, agentName, now)
+				}
+			}
+			time.Sleep(certificateCheckInterval)
+		}
+	}()
+	return nil
+}
+
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
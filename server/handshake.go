@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+)
+
+const handshakeTimeout = 30 * time.Second
+
+// handshakeConn is a remote connection whose client waits for a reply (SOCKS5 or service request) until the agent
+// either establishes the transfer connection or refuses it.
+type handshakeConn struct {
+	net.Conn
+	replyOnce  sync.Once
+	writeReply func(conn net.Conn, established bool) error
+}
+
+func (c *handshakeConn) reply(established bool) error {
+	var err error
+	c.replyOnce.Do(func() {
+		err = c.writeReply(c.Conn, established)
+	})
+	return err
+}
+
+// CloseWrite passes a half-close on to the client connection.
+func (c *handshakeConn) CloseWrite() error {
+	return connectivity.CloseWrite(c.Conn)
+}
+
+// socksHandshake reads the SOCKS5 CONNECT request of a client and the username it picks an agent with. The
+// connection is closed on failure.
+func socksHandshake(conn net.Conn, password string) (string, string, bool) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	destination, username, err := connectivity.Socks5AcceptConnect(conn, password)
+	if err != nil {
+		log.With(logs.FieldClientAddress, conn.RemoteAddr()).Warningf("SOCKS5 handshake failed. Closing the connection. Cause: %s", err)
+		conn.Close()
+		return "", "", false
+	}
+	conn.SetDeadline(time.Time{})
+	return destination, username, true
+}
+
+// openSocksConn asks the agent to connect to the destination a SOCKS5 client requested.
+func (s *server) openSocksConn(conn net.Conn, destination string, accepted time.Time) {
+	id := s.addConn(&handshakeConn{Conn: conn, writeReply: func(conn net.Conn, established bool) error {
+		if established {
+			return connectivity.WriteSocks5Reply(conn, connectivity.Socks5ReplySucceeded)
+		}
+		return connectivity.WriteSocks5Reply(conn, connectivity.Socks5ReplyHostUnreachable)
+	}}, destination, accepted)
+	s.traceHandshake(id, "socks5", accepted)
+	s.connLog(id).Infof("Accepted a new SOCKS5 connection to %s", destination)
+	s.openConnection(id, destination)
+}
+
+// readServiceRequest reads the name of the service a client requests. The connection is closed on failure.
+func readServiceRequest(conn net.Conn) (string, bool) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	serviceName, err := connectivity.ReadServiceRequest(conn)
+	if err != nil {
+		log.With(logs.FieldClientAddress, conn.RemoteAddr()).Warningf("Could not read the service request. Closing the connection. Cause: %s", err)
+		conn.Close()
+		return "", false
+	}
+	conn.SetDeadline(time.Time{})
+	return serviceName, true
+}
+
+func rejectServiceRequest(conn net.Conn, serviceName string) {
+	log.With(logs.FieldClientAddress, conn.RemoteAddr()).Warningf("Client requested unknown service: %s Closing the connection", serviceName)
+	connectivity.WriteServiceResponse(conn, connectivity.ServiceUnknown)
+	conn.Close()
+}
+
+// openServiceConn asks the agent to open a connection to its service for a client.
+func (s *server) openServiceConn(conn net.Conn, serviceName string, accepted time.Time) {
+	id := s.addConn(&handshakeConn{Conn: conn, writeReply: func(conn net.Conn, established bool) error {
+		if established {
+			return connectivity.WriteServiceResponse(conn, connectivity.ServiceAccepted)
+		}
+		return connectivity.WriteServiceResponse(conn, connectivity.ServiceUnavailable)
+	}}, "", accepted)
+	s.traceHandshake(id, "service_request", accepted)
+	s.connLog(id).Infof("Accepted a new client connection for service: %s", serviceName)
+	s.openConnection(id, "")
+}
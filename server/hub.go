@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/logs"
+	"project-proxy/metrics"
+)
+
+// Hub owns the listeners shared by all connected agents. Every new connection goes to one of the agents serving the
+// requested service, as the balancer picks; an agent that goes offline leaves its service pool without affecting the
+// others.
+type Hub interface {
+	SetSocksConnFactory(socksConnFactory connectivity.ConnFactory)
+	// SetSocksPassword sets the password SOCKS5 clients must authenticate with. The username picks the agent by name.
+	SetSocksPassword(password string)
+	SetClientConnFactory(clientConnFactory connectivity.ConnFactory)
+	// SetIncomingService sets the service that connections to the incoming (and SOCKS5) address are for. Empty
+	// pools all agents as long as they serve the same service and refuses the connections while they do not. SOCKS5
+	// connections only go to agents whose LAN allow-list permits their destination.
+	SetIncomingService(serviceName string)
+	// SetRelay sets where connections that no local agent serves are relayed to, e.g. another node of a cluster.
+	SetRelay(relay Relay)
+	// Listen binds all listeners and accepts their connections in the background until ctx is done.
+	Listen(ctx context.Context) error
+	// ServeRelayed serves a connection relayed from another node. It starts with a service request, like a client
+	// connection, and is only served by local agents.
+	ServeRelayed(conn net.Conn)
+	owner(connId uint32) *server
+}
+
+// Relay opens connections to services through another server.
+type Relay interface {
+	// Relay returns a connection to the service (any service if empty) that another server's agent accepted.
+	Relay(serviceName string) (net.Conn, error)
+}
+
+type hub struct {
+	registry            Registry
+	balancer            Balancer
+	incomingConnFactory connectivity.ConnFactory
+	transferConnFactory connectivity.ConnFactory
+	socksConnFactory    connectivity.ConnFactory
+	socksPassword       string
+	clientConnFactory   connectivity.ConnFactory
+	incomingService     string
+	relay               Relay
+}
+
+func NewHub(registry Registry, incomingConnFactory connectivity.ConnFactory, transferConnFactory connectivity.ConnFactory, balancer Balancer) Hub {
+	return &hub{
+		registry:            registry,
+		balancer:            balancer,
+		incomingConnFactory: incomingConnFactory,
+		transferConnFactory: transferConnFactory,
+	}
+}
+
+func (h *hub) SetSocksConnFactory(socksConnFactory connectivity.ConnFactory) {
+	h.socksConnFactory = socksConnFactory
+}
+
+func (h *hub) SetSocksPassword(password string) {
+	h.socksPassword = password
+}
+
+func (h *hub) SetClientConnFactory(clientConnFactory connectivity.ConnFactory) {
+	h.clientConnFactory = clientConnFactory
+}
+
+func (h *hub) SetIncomingService(serviceName string) {
+	h.incomingService = serviceName
+}
+
+func (h *hub) SetRelay(relay Relay) {
+	h.relay = relay
+}
+
+func (h *hub) Listen(ctx context.Context) error {
+	transferListener, err := h.transferConnFactory.ListenContext(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Listening for transfer connections at %s", describe(h.transferConnFactory))
+	go h.accept("transfer", transferListener, h.handleTransferConn)
+
+	listeners := []struct {
+		kind    string
+		factory connectivity.ConnFactory
+		handle  func(conn net.Conn)
+	}{
+		{"remote", h.incomingConnFactory, h.handleRemoteConn},
+		{"SOCKS5", h.socksConnFactory, h.handleSocksConn},
+		{"client", h.clientConnFactory, h.handleClientConn},
+	}
+	for _, l := range listeners {
+		if l.factory == nil {
+			continue
+		}
+		ln, err := l.factory.ListenContext(ctx)
+		if err != nil {
+			transferListener.Close()
+			return err
+		}
+		log.Infof("Listening for %s connections at %s", l.kind, describe(l.factory))
+		go h.accept(l.kind, ln, l.handle)
+	}
+	return nil
+}
+
+func (h *hub) accept(kind string, ln net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Errorf("Error while accepting %s connection. No more %s connections will be accepted. Cause: %s", kind, kind, err)
+			return
+		}
+		go handle(conn)
+	}
+}
+
+func (h *hub) handleRemoteConn(conn net.Conn) {
+	s := h.pick(h.incomingService)
+	if s == nil {
+		if !h.relayConn(conn, h.incomingService, nil) {
+			h.refuse(conn, h.incomingService)
+		}
+		return
+	}
+	s.handleRemoteConn(conn)
+}
+
+func (h *hub) handleSocksConn(conn net.Conn) {
+	accepted := time.Now()
+	destination, agentName, ok := socksHandshake(conn, h.socksPassword)
+	if !ok {
+		return
+	}
+	pool := h.socksPool(destination, agentName)
+	if len(pool) > 1 && agentName == "" {
+		log.With(logs.FieldClientAddress, conn.RemoteAddr()).Warningf("Several agents allow the SOCKS5 destination: %s and the client picked none by username. Closing the connection", destination)
+		metrics.OpenFailuresTotal.Inc("destination_ambiguous")
+		connectivity.WriteSocks5Reply(conn, connectivity.Socks5ReplyNotAllowed)
+		conn.Close()
+		return
+	}
+	s := h.balancer.pick(pool)
+	if s == nil {
+		if len(h.serving(h.incomingService)) > 0 {
+			log.With(logs.FieldClientAddress, conn.RemoteAddr()).Warningf("No agent allows the SOCKS5 destination: %s Closing the connection", destination)
+			metrics.OpenFailuresTotal.Inc("destination_not_allowed")
+			connectivity.WriteSocks5Reply(conn, connectivity.Socks5ReplyNotAllowed)
+			conn.Close()
+			return
+		}
+		connectivity.WriteSocks5Reply(conn, connectivity.Socks5ReplyHostUnreachable)
+		h.refuse(conn, h.incomingService)
+		return
+	}
+	s.openSocksConn(conn, destination, accepted)
+}
+
+func (h *hub) handleClientConn(conn net.Conn) {
+	accepted := time.Now()
+	serviceName, ok := readServiceRequest(conn)
+	if !ok {
+		return
+	}
+	s := h.pick(serviceName)
+	if s == nil {
+		accept := func() error {
+			return connectivity.WriteServiceResponse(conn, connectivity.ServiceAccepted)
+		}
+		if !h.relayConn(conn, serviceName, accept) {
+			h.rejectServiceRequest(conn, serviceName)
+		}
+		return
+	}
+	s.openServiceConn(conn, serviceName, accepted)
+}
+
+func (h *hub) ServeRelayed(conn net.Conn) {
+	accepted := time.Now()
+	serviceName, ok := readServiceRequest(conn)
+	if !ok {
+		return
+	}
+	s := h.pick(serviceName)
+	if s == nil {
+		h.rejectServiceRequest(conn, serviceName)
+		return
+	}
+	s.openServiceConn(conn, serviceName, accepted)
+}
+
+// relayConn hands a connection no local agent serves over to the relay and proxies it there. accept, if set, tells
+// the client its connection was accepted. It returns false if the connection could not be relayed and is still to be
+// refused.
+func (h *hub) relayConn(conn net.Conn, serviceName string, accept func() error) bool {
+	if h.relay == nil {
+		return false
+	}
+	clientLog := log.With(logs.FieldClientAddress, conn.RemoteAddr())
+	peer, err := h.relay.Relay(serviceName)
+	if err != nil {
+		clientLog.Warningf("Could not relay the connection for service: %q Cause: %s", serviceName, err)
+		return false
+	}
+	if accept != nil {
+		if err := accept(); err != nil {
+			clientLog.Warningf("Could not accept the relayed connection. Closing it. Cause: %s", err)
+			conn.Close()
+			peer.Close()
+			return true
+		}
+	}
+	clientLog.Infof("Relaying the connection for service: %q to %s", serviceName, peer.RemoteAddr())
+	metrics.RelayedConnectionsTotal.Inc(serviceName)
+	p := connectivity.NewConnProxy(conn, peer)
+	p.SetLogFields(logs.FieldClientAddress, conn.RemoteAddr())
+	p.RunAsync()
+	return true
+}
+
+func (h *hub) handleTransferConn(transferConn net.Conn) {
+	connId, err := readConnId(transferConn)
+	if err != nil {
+		return
+	}
+	s := h.owner(connId)
+	if s == nil {
+		log.With(logs.FieldConnId, connId).Errorf("Proxy cannot be created. Closing the transfer connection. Cause: could not find the remote connection")
+		metrics.OpenFailuresTotal.Inc("unknown_connection")
+		transferConn.Close()
+		return
+	}
+	s.proxyTransferConn(transferConn, connId)
+}
+
+func (h *hub) refuse(conn net.Conn, serviceName string) {
+	if h.unhealthy(serviceName) {
+		refuseUnhealthy(conn, serviceName)
+		return
+	}
+	clientLog := log.With(logs.FieldClientAddress, conn.RemoteAddr())
+	if serviceName == "" && h.mixedServices() {
+		clientLog.Warningf("The connected agents serve different services and no service is set for the incoming connections. Closing the connection")
+	} else {
+		clientLog.Warningf("No agent serves service: %q Closing the connection", serviceName)
+	}
+	metrics.OpenFailuresTotal.Inc("no_agent")
+	conn.Close()
+}
+
+// rejectServiceRequest answers a client whose service no agent can take the connection for.
+func (h *hub) rejectServiceRequest(conn net.Conn, serviceName string) {
+	if h.unhealthy(serviceName) {
+		rejectUnhealthy(conn, serviceName)
+		return
+	}
+	metrics.OpenFailuresTotal.Inc("no_agent")
+	rejectServiceRequest(conn, serviceName)
+}
+
+// pick returns the agent a new connection for a service goes to, or nil if no connected agent with a healthy local
+// target serves it.
+func (h *hub) pick(serviceName string) *server {
+	var pool []*server
+	for _, s := range h.serving(serviceName) {
+		if s.isTargetHealthy() {
+			pool = append(pool, s)
+		}
+	}
+	return h.balancer.pick(pool)
+}
+
+// socksPool returns the agents a SOCKS5 connection may go to: those serving the incoming service whose LAN allow-list
+// permits the destination and, unless agentName is empty, that have that name. A name is resolved here before it is
+// matched against CIDR rules. The health of the local target does not matter, as SOCKS5 connections go to
+// destinations of their own.
+func (h *hub) socksPool(destination string, agentName string) []*server {
+	var resolved []net.IP
+	if host, _, err := net.SplitHostPort(destination); err == nil && net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		resolved, _ = net.DefaultResolver.LookupIP(ctx, "ip", host)
+		cancel()
+	}
+	var pool []*server
+	for _, s := range h.serving(h.incomingService) {
+		if _, name := s.getIdentity(); agentName != "" && name != agentName {
+			continue
+		}
+		if s.allows(destination, resolved) {
+			pool = append(pool, s)
+		}
+	}
+	return pool
+}
+
+// unhealthy tells if connected agents serve the service but the local targets of all of them are unhealthy.
+func (h *hub) unhealthy(serviceName string) bool {
+	servers := h.serving(serviceName)
+	for _, s := range servers {
+		if s.isTargetHealthy() {
+			return false
+		}
+	}
+	return len(servers) > 0
+}
+
+// serving returns the listening agents that said hello and serve a service. An empty service stands for the one
+// service all agents serve: if they serve different ones, there is no pool, as their connections must not mix.
+func (h *hub) serving(serviceName string) []*server {
+	if serviceName == "" && h.mixedServices() {
+		return nil
+	}
+	var servers []*server
+	for _, s := range h.servers() {
+		if s.IsListening() && s.hasGreeted() && (serviceName == "" || s.getServiceName() == serviceName) {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// mixedServices tells if the listening agents serve more than one service.
+func (h *hub) mixedServices() bool {
+	services := make(map[string]bool)
+	for _, s := range h.servers() {
+		if s.IsListening() && s.hasGreeted() {
+			services[s.getServiceName()] = true
+		}
+	}
+	return len(services) > 1
+}
+
+// owner returns the agent a connection id belongs to.
+func (h *hub) owner(connId uint32) *server {
+	for _, s := range h.servers() {
+		if s.getTunnel(connId) != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (h *hub) servers() []*server {
+	var servers []*server
+	for _, s := range h.registry.GetServers() {
+		if s, ok := s.(*server); ok {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+func (s *server) SetHub(hub Hub) {
+	s.hub = hub
+}
+
+func describe(factory connectivity.ConnFactory) string {
+	return connectivity.DescribeAddress(factory.GetNetworkType(), factory.GetAddress())
+}
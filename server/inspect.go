@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sort"
+	"time"
+)
+
+type AgentInfo struct {
+	Name        string    `json:"name"`
+	Address     string    `json:"address"`
+	Identity    string    `json:"identity"`
+	Service     string    `json:"service"`
+	Version     string    `json:"version"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	RTT         RTTInfo   `json:"rtt"`
+	Health      string    `json:"health"`
+	// HealthReason is why the local target failed its probes, if it is unhealthy.
+	HealthReason    string     `json:"healthReason,omitempty"`
+	HealthChangedAt *time.Time `json:"healthChangedAt,omitempty"`
+	// CertificateExpiresAt is the expiry of the certificate the agent authenticated with, if any.
+	CertificateExpiresAt *time.Time `json:"certificateExpiresAt,omitempty"`
+}
+
+// RTTInfo holds the control connection round-trip times in milliseconds.
+type RTTInfo struct {
+	Samples uint64  `json:"samples"`
+	Last    float64 `json:"lastMs"`
+	Min     float64 `json:"minMs"`
+	Avg     float64 `json:"avgMs"`
+	Max     float64 `json:"maxMs"`
+	Jitter  float64 `json:"jitterMs"`
+}
+
+type ConnectionInfo struct {
+	Id            uint32    `json:"id"`
+	ClientAddress string    `json:"clientAddress"`
+	Service       string    `json:"service"`
+	Agent         string    `json:"agent"`
+	OpenedAt      time.Time `json:"openedAt"`
+	AgeSeconds    float64   `json:"ageSeconds"`
+	Proxied       bool      `json:"proxied"`
+	BytesIn       uint64    `json:"bytesIn"`
+	BytesOut      uint64    `json:"bytesOut"`
+}
+
+func (s *server) SetControlConn(controlConn net.Conn) {
+	s.controlConn = controlConn
+}
+
+func (s *server) SetRegistry(registry Registry) {
+	s.registry = registry
+}
+
+func (s *server) GetAgentInfo() AgentInfo {
+	s.identityMutex.Lock()
+	info := AgentInfo{
+		Name:        s.agentName,
+		Service:     s.serviceName,
+		Version:     s.agentVersion,
+		ConnectedAt: s.connectedAt,
+		Health:      s.targetHealth,
+	}
+	info.HealthReason = s.healthReason
+	if !s.healthChangedAt.IsZero() {
+		changedAt := s.healthChangedAt
+		info.HealthChangedAt = &changedAt
+	}
+	s.identityMutex.Unlock()
+	stats := s.messenger.GetRTTStats()
+	info.RTT = RTTInfo{
+		Samples: stats.Samples,
+		Last:    milliseconds(stats.Last),
+		Min:     milliseconds(stats.Min),
+		Avg:     milliseconds(stats.Avg),
+		Max:     milliseconds(stats.Max),
+		Jitter:  milliseconds(stats.Jitter),
+	}
+	if s.controlConn != nil {
+		info.Address = s.controlConn.RemoteAddr().String()
+		if cert := peerCertificate(s.controlConn); cert != nil {
+			info.Identity = cert.Subject.String()
+			notAfter := cert.NotAfter
+			info.CertificateExpiresAt = &notAfter
+		}
+	}
+	return info
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// peerCertificate returns the certificate the agent authenticated with, if the control connection uses TLS.
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+func (s *server) GetConnections() []ConnectionInfo {
+	serviceName, agentName := s.getIdentity()
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	infos := make([]ConnectionInfo, 0, len(s.localConns))
+	for id, t := range s.localConns {
+		info := ConnectionInfo{
+			Id:            id,
+			ClientAddress: t.conn.RemoteAddr().String(),
+			Service:       serviceName,
+			Agent:         agentName,
+			OpenedAt:      t.accepted,
+			AgeSeconds:    time.Since(t.accepted).Seconds(),
+			Proxied:       t.proxy != nil,
+		}
+		if t.proxy != nil {
+			info.BytesIn, info.BytesOut = t.proxy.GetBytesTransferred()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].OpenedAt.Before(infos[j].OpenedAt)
+	})
+	return infos
+}
+
+// CloseConnection forcibly closes a tunneled connection. It returns false if the connection is unknown.
+func (s *server) CloseConnection(id uint32) bool {
+	t := s.getTunnel(id)
+	if t == nil {
+		return false
+	}
+	t.log.Warningf("Forcibly closing the remote connection")
+	if proxy := s.getProxy(id); proxy != nil {
+		proxy.Stop()
+		return true
+	}
+	t.conn.Close()
+	s.dropConn(id, closeAdminKill)
+	s.messenger.SendCloseConn(id)
+	return true
+}
+
+// Disconnect closes the control connection, which tears the server down like any other connectivity loss.
+func (s *server) Disconnect() {
+	log.Warningf("Forcibly disconnecting agent: %s", s.GetAgentInfo().Name)
+	s.messenger.Close()
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnLimits bound how long a tunneled connection may stay idle (no bytes either way) and how long it may stay open
+// at all. Zero disables a limit. The per-service maps override the defaults for the agents serving those services.
+type ConnLimits struct {
+	IdleTimeout         time.Duration
+	MaxLifetime         time.Duration
+	ServiceIdleTimeouts map[string]time.Duration
+	ServiceMaxLifetimes map[string]time.Duration
+}
+
+// forService returns the idle timeout and the max lifetime of the connections of a service.
+func (l ConnLimits) forService(serviceName string) (time.Duration, time.Duration) {
+	idleTimeout, maxLifetime := l.IdleTimeout, l.MaxLifetime
+	if d, ok := l.ServiceIdleTimeouts[serviceName]; ok {
+		idleTimeout = d
+	}
+	if d, ok := l.ServiceMaxLifetimes[serviceName]; ok {
+		maxLifetime = d
+	}
+	return idleTimeout, maxLifetime
+}
+
+// ParseServiceDurations parses comma separated service=milliseconds pairs, e.g. ssh=3600000,web=60000.
+func ParseServiceDurations(list string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid service duration: %s", pair)
+		}
+		ms, err := strconv.Atoi(pair[i+1:])
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid service duration: %s", pair)
+		}
+		durations[pair[:i]] = time.Duration(ms) * time.Millisecond
+	}
+	return durations, nil
+}
+
+// SetConnLimits sets the limits applied to the connections proxied from now on.
+func (s *server) SetConnLimits(limits ConnLimits) {
+	s.connLimits = limits
+}
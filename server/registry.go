@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+)
+
+// Registry keeps track of the servers whose agents are currently connected, so they can be inspected at runtime.
+type Registry interface {
+	Register(s Server)
+	Unregister(s Server)
+	GetServers() []Server
+	// join registers a server and tells if no other one serves its service, i.e. the service just came up, and if an
+	// agent with its identity joined before.
+	join(s *server) (bool, bool)
+	// leave unregisters a server and tells if no other one serves its service, i.e. the service just went down.
+	leave(s *server) bool
+}
+
+type registry struct {
+	servers []Server
+	mutex   sync.Mutex
+	// identities holds the session identities of the named agents that ever joined.
+	identities map[string]bool
+}
+
+func NewRegistry() Registry {
+	return &registry{
+		identities: make(map[string]bool),
+	}
+}
+
+func (r *registry) Register(s Server) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.servers = append(r.servers, s)
+}
+
+func (r *registry) Unregister(s Server) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, v := range r.servers {
+		if v == s {
+			r.servers = append(r.servers[:i], r.servers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *registry) GetServers() []Server {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Server(nil), r.servers...)
+}
+
+func (r *registry) join(s *server) (bool, bool) {
+	_, agentName := s.getIdentity()
+	identity := s.sessionIdentity()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	first := !r.serves(s.getServiceName())
+	r.servers = append(r.servers, s)
+	known := false
+	if agentName != "" {
+		known = r.identities[identity]
+		r.identities[identity] = true
+	}
+	return first, known
+}
+
+func (r *registry) leave(s *server) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, v := range r.servers {
+		if v == s {
+			r.servers = append(r.servers[:i], r.servers[i+1:]...)
+			return !r.serves(s.getServiceName())
+		}
+	}
+	return false
+}
+
+// serves tells if a registered server serves the service. The caller holds the mutex.
+func (r *registry) serves(serviceName string) bool {
+	for _, v := range r.servers {
+		if v, ok := v.(*server); ok && v.getServiceName() == serviceName {
+			return true
+		}
+	}
+	return false
+}
@@ -1,113 +1,315 @@
 package server
 
 import (
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"math/rand"
 	"project-proxy/messaging"
 	"project-proxy/logs"
 	"encoding/binary"
 	"project-proxy/connectivity"
+	"project-proxy/events"
+	"project-proxy/metrics"
+	"project-proxy/tracing"
 	"time"
 )
 
 type server struct {
-	messenger           messaging.MessengerOverlay
-	remoteConnFactory   connectivity.ConnFactory
-	transferConnFactory connectivity.ConnFactory
-	pingInterval        time.Duration
-	bufferSize          uint64
-	localConns          map[uint32]net.Conn
-	waitUntilFinished   chan bool
+	messenger         messaging.MessengerOverlay
+	pingInterval      time.Duration
+	agentName         string
+	serviceName       string
+	agentVersion      string
+	allowList         connectivity.AllowList
+	targetHealth      string
+	healthReason      string
+	healthChangedAt   time.Time
+	identityMutex     sync.Mutex
+	controlConn       net.Conn
+	connectedAt       time.Time
+	registry          Registry
+	accessLog         logs.AccessLog
+	sessions          Sessions
+	connLimits        ConnLimits
+	sessionToken      string
+	greeted           bool
+	lost              bool
+	superseded        bool
+	bufferSize        uint64
+	localConns        map[uint32]*tunnel
+	localConnsMutex   sync.Mutex
+	waitUntilFinished chan bool
+	finishOnce        sync.Once
+	hub               Hub
+	listening         int32
 }
 
+// tunnel is a remote connection together with what the server tracks about it.
+type tunnel struct {
+	conn        net.Conn
+	destination string
+	accepted    time.Time
+	proxy       connectivity.ConnProxy
+	log         *logs.Logger
+	closeReason string
+	span        *tracing.Span
+	step        *tracing.Span
+	// owner is the server the tunnel belongs to, which changes when a resumed session adopts it.
+	owner *server
+}
+
+// ownersMutex guards the owner of every tunnel.
+var ownersMutex sync.Mutex
+
+func (t *tunnel) getOwner() *server {
+	ownersMutex.Lock()
+	defer ownersMutex.Unlock()
+	return t.owner
+}
+
+// remove removes the tunnel from its owner. The owner is looked up under ownersMutex, so a tunnel adopted meanwhile
+// is removed from the server that adopted it.
+func (t *tunnel) remove(id uint32) {
+	ownersMutex.Lock()
+	defer ownersMutex.Unlock()
+	t.owner.removeTunnel(id, t)
+}
+
+const (
+	listeningStarting int32 = iota
+	listeningBound
+	listeningStopped
+)
+
 type Config struct {
 }
 
 type Server interface {
 	Start()
 	Wait()
+	SetControlConn(controlConn net.Conn)
+	SetRegistry(registry Registry)
+	SetAccessLog(accessLog logs.AccessLog)
+	SetSessions(sessions Sessions)
+	SetConnLimits(limits ConnLimits)
+	SetHub(hub Hub)
+	GetAgentInfo() AgentInfo
+	GetConnections() []ConnectionInfo
+	CloseConnection(id uint32) bool
+	Disconnect()
+	IsListening() bool
 }
 
 var log = logs.GetLoggerForModule("server")
 
-func NewServer(remoteConnFactory connectivity.ConnFactory, transferConnFactory connectivity.ConnFactory, pingInterval time.Duration, bufferSize uint64, overlay messaging.MessengerOverlay) Server {
+func NewServer(pingInterval time.Duration, bufferSize uint64, overlay messaging.MessengerOverlay) Server {
 	return &server{
-		messenger:           overlay,
-		remoteConnFactory:   remoteConnFactory,
-		transferConnFactory: transferConnFactory,
-		pingInterval:        pingInterval,
-		bufferSize:          bufferSize,
-		localConns:          make(map[uint32]net.Conn),
-		waitUntilFinished:   make(chan bool),
+		messenger:         overlay,
+		pingInterval:      pingInterval,
+		bufferSize:        bufferSize,
+		localConns:        make(map[uint32]*tunnel),
+		waitUntilFinished: make(chan bool),
+		targetHealth:      TargetHealthUnknown,
 	}
 }
 
 func (s *server) Start() {
 	onReceive := func(id uint32, service uint32, payload []byte, err error) {
 		if err != nil {
-			log.Warningf("Received an errorous message - id: %d , service: %d This message will be ignored. Cause: %s", id, service, err)
+			log.With(logs.FieldConnId, id).Warningf("Received an errorous message - service: %d This message will be ignored. Cause: %s", service, err)
 			return
 		}
-		log.Debugf("Received a forward message - id: %d , service: %d, len: %d", id, service, len(payload))
-		conn := s.localConns[id]
+		clog := s.connLog(id)
+		clog.Debugf("Received a forward message - service: %d, len: %d", service, len(payload))
+		conn := s.getConn(id)
 		if conn == nil {
-			log.Warningf("Attempting to write to a non-existent remote connection. This message will be ignored. Sending request to close local connection")
+			clog.Warningf("Attempting to write to a non-existent remote connection. This message will be ignored. Sending request to close local connection")
 			s.messenger.SendCloseConn(id)
 			return
 		}
-		log.Debugf("Writing bytes (total: %d) to remote connection id: %d", len(payload), id)
+		clog.Debugf("Writing bytes (total: %d) to remote connection", len(payload))
 		length, err := conn.Write(payload)
 		if err != nil {
-			log.Errorf("Error while writing to remote connection. Closing local connection. Sending request to close local connection. Cause: %s", err)
+			clog.Errorf("Error while writing to remote connection. Closing local connection. Sending request to close local connection. Cause: %s", err)
 			conn.Close()
-			delete(s.localConns, id)
+			s.dropConn(id, closeError)
 			s.messenger.SendCloseConn(id)
 			return
 		} else if length == 0 {
-			log.Warningf("Written no bytes to remote connection id: %d This usually indicates a timeout. Closing remote connection. Sending request to close local connection", id)
+			clog.Warningf("Written no bytes to remote connection. This usually indicates a timeout. Closing remote connection. Sending request to close local connection")
 			conn.Close()
-			delete(s.localConns, id)
+			s.dropConn(id, closeTimeout)
 			s.messenger.SendCloseConn(id)
 			return
 		}
-		log.Debugf("Successfully written %d of %d bytes to a remote connection id: %d", length, len(payload), id)
+		clog.Debugf("Successfully written %d of %d bytes to the remote connection", length, len(payload))
 	}
 	onCloseConn := func(remoteConnId uint32, err error) {
 		if err != nil {
 			log.Errorf("Erroreous request to close a remote connection. This message will be ignored. Cause: %s", err)
 			return
 		}
-		log.Infof("Received a request to close a remote connection id: %d", remoteConnId)
-		conn := s.localConns[remoteConnId]
-		if conn == nil {
-			log.Warningf("Cannot close remote connection id: %d Unknown connection. This message will be ignored", remoteConnId)
+		t := s.getTunnel(remoteConnId)
+		if t == nil {
+			log.With(logs.FieldConnId, remoteConnId).Warningf("Cannot close remote connection. Unknown connection. This message will be ignored")
 			return
 		}
-		log.Infof("Closing remote connection connection id: %d", remoteConnId)
+		clog := t.log
+		clog.Infof("Received a request to close the remote connection")
+		conn := t.conn
+		proxied := s.getProxy(remoteConnId) != nil
+		if !proxied {
+			metrics.OpenFailuresTotal.Inc("agent_refused")
+			serviceName, agentName := s.getIdentity()
+			events.Publish(events.Event{Type: events.ConnectionClosed, Agent: agentName, Service: serviceName,
+				ConnectionId: remoteConnId, ClientAddress: conn.RemoteAddr().String(), Message: "refused by the agent"})
+		}
+		clog.Infof("Closing the remote connection")
+		if hc, ok := conn.(*handshakeConn); ok {
+			hc.reply(false)
+		}
 		error := conn.Close()
-		delete(s.localConns, remoteConnId)
+		if proxied {
+			s.removeConn(remoteConnId)
+		} else {
+			s.dropConn(remoteConnId, closeAgentRefused)
+		}
 		if error != nil {
-			log.Warningf("Closing a remote connection id: %d failed. Connection was removed from the connection list. Cause: %s", error)
+			clog.Warningf("Closing the remote connection failed. Connection was removed from the connection list. Cause: %s", error)
 			return
 		}
-		log.Infof("Successfuly closed remote connection id: %d", remoteConnId)
+		clog.Infof("Successfuly closed the remote connection")
+	}
+	onHello := func(agentName string, serviceName string, agentVersion string, sessionToken string, allowList string, err error) {
+		if err != nil {
+			log.Errorf("Erroreous hello message. This message will be ignored. Cause: %s", err)
+			return
+		}
+		log.With(logs.FieldAgent, agentName, logs.FieldService, serviceName).Infof("Agent: %s (version: %s) announced service: %s", agentName, agentVersion, serviceName)
+		parsedAllowList, err := connectivity.ParseAllowList(allowList)
+		if err != nil {
+			log.With(logs.FieldAgent, agentName).Warningf("The agent announced an invalid LAN allow-list. No SOCKS5 connections will be routed to it. Cause: %s", err)
+		}
+		s.identityMutex.Lock()
+		if s.lost {
+			s.identityMutex.Unlock()
+			log.With(logs.FieldAgent, agentName).Warningf("Hello message arrived after the control connection was lost. This message will be ignored")
+			return
+		}
+		s.agentName = agentName
+		s.serviceName = serviceName
+		s.agentVersion = agentVersion
+		s.sessionToken = sessionToken
+		s.allowList = parsedAllowList
+		first := !s.greeted
+		s.greeted = true
+		s.identityMutex.Unlock()
+		serviceUp := false
+		// reconnected tells a control connection of an agent that connected before, by its session or its identity,
+		// from the first one of an agent.
+		reconnected := false
+		if first && s.registry != nil {
+			serviceUp, reconnected = s.registry.join(s)
+		}
+		if s.sessions != nil && sessionToken != "" {
+			identity := s.sessionIdentity()
+			old := s.liveSession(sessionToken, identity)
+			if old != nil {
+				s.agentLog().Warningf("Agent reconnected before the loss of its old control connection was noticed. Taking its session over")
+				adopted := s.adopt(old)
+				old.messenger.Close()
+				s.agentLog().Infof("Agent resumed its session. Re-attached %d connections", adopted)
+				metrics.SessionResumesTotal.Inc()
+				reconnected = true
+			} else if old := s.sessions.resume(sessionToken, identity); old != nil {
+				adopted := s.adopt(old)
+				s.agentLog().Infof("Agent resumed its session. Re-attached %d connections", adopted)
+				metrics.SessionResumesTotal.Inc()
+				reconnected = true
+			}
+		}
+		if reconnected {
+			metrics.ControlReconnectsTotal.Inc()
+		}
+		events.Publish(events.Event{Type: events.AgentConnected, Agent: agentName, Service: serviceName,
+			Message: "version " + agentVersion})
+		if serviceUp && serviceName != "" {
+			events.Publish(events.Event{Type: events.ServiceUp, Agent: agentName, Service: serviceName})
+		}
 	}
-	var remoteListener net.Listener
-	var transferListener net.Listener
 	onControlConnLost := func(err error) {
-		log.Errorf("Control connection lost. Closing all remote connections. Stopping listening for new remote connections. Signalling that the server has finished. Cause: %s", err)
-		remoteListener.Close()
-		transferListener.Close()
-		for _, v := range s.localConns {
-			v.Close()
+		atomic.StoreInt32(&s.listening, listeningStopped)
+		s.identityMutex.Lock()
+		greeted := s.greeted
+		superseded := s.superseded
+		s.lost = true
+		s.identityMutex.Unlock()
+		if greeted {
+			s.agentLog().Errorf("Control connection lost. Closing the remote connections that are not resumable. Stopping listening for new remote connections. Signalling that the server has finished. Cause: %s", err)
+		} else {
+			log.With(logs.FieldPeerAddress, s.agentAddress()).Infof("The control connection was closed before the agent said hello, e.g. by a probe. Signalling that the server has finished. Cause: %s", err)
 		}
-		s.waitUntilFinished <- true
+		s.identityMutex.Lock()
+		sessionToken := s.sessionToken
+		s.identityMutex.Unlock()
+		suspend := s.sessions != nil && sessionToken != "" && !superseded
+		s.localConnsMutex.Lock()
+		var unproxied []uint32
+		kept := 0
+		for id, v := range s.localConns {
+			if (suspend || superseded) && v.proxy != nil {
+				kept++
+				continue
+			}
+			v.closeReason = closeControlLost
+			if v.proxy == nil {
+				unproxied = append(unproxied, id)
+			}
+			v.conn.Close()
+		}
+		s.localConnsMutex.Unlock()
+		for _, id := range unproxied {
+			s.dropConn(id, closeControlLost)
+		}
+		if !greeted || superseded {
+			s.finish()
+			return
+		}
+		serviceDown := false
+		if s.registry != nil {
+			serviceDown = s.registry.leave(s)
+		}
+		if suspend {
+			s.agentLog().Warningf("Keeping %d proxied connections for the agent to resume its session", kept)
+			s.sessions.suspend(sessionToken, s.sessionIdentity(), s)
+		}
+		serviceName, agentName := s.getIdentity()
+		metrics.TargetHealthy.Delete(serviceName, agentName)
+		if serviceDown && serviceName != "" {
+			events.Publish(events.Event{Type: events.ServiceDown, Agent: agentName, Service: serviceName,
+				Message: fmt.Sprint(err)})
+		}
+		events.Publish(events.Event{Type: events.AgentDisconnected, Agent: agentName, Service: serviceName,
+			Message: fmt.Sprint(err)})
+		s.finish()
 	}
 	s.messenger.SetOnForwardListener(onReceive)
 	s.messenger.SetOnCloseConnectionListener(onCloseConn)
+	s.messenger.SetOnHelloListener(onHello)
+	s.messenger.SetOnServiceHealthListener(s.onServiceHealth)
 	s.messenger.SetOnControlConnectionLostListener(onControlConnLost)
+	s.messenger.SetOnPongListener(func(rtt time.Duration, stats messaging.RTTStats) {
+		_, agentName := s.getIdentity()
+		metrics.ControlRTTSeconds.Observe(rtt.Seconds(), agentName)
+		metrics.ControlRTTJitterSeconds.Set(stats.Jitter.Seconds(), agentName)
+	})
 
-	log.Infof("Starting server - network type: %s, remote connections address: %s", s.remoteConnFactory.GetNetworkType(), s.remoteConnFactory.GetAddress())
+	log.Infof("Starting server - agent addr: %s", s.agentAddress())
+	s.identityMutex.Lock()
+	s.connectedAt = time.Now()
+	s.identityMutex.Unlock()
 	s.messenger.Start()
 	if s.pingInterval > 0 {
 		log.Infof("The server will be pinged every %d ms", s.pingInterval/time.Millisecond)
@@ -116,60 +318,218 @@ func (s *server) Start() {
 		log.Warningf("The agent will not be pinged (setting value: %d). It can cause timeout problems across NATs or filewalls", s.pingInterval)
 	}
 
-	log.Infof("Trying to listen for remote connections - network type: %s, address: %s", s.remoteConnFactory.GetNetworkType(), s.remoteConnFactory.GetAddress())
-	remoteListener, err := s.remoteConnFactory.Listen()
+	atomic.CompareAndSwapInt32(&s.listening, listeningStarting, listeningBound)
+}
+
+// IsListening tells if the server takes new connections from the hub, which it does from the end of Start until the
+// control connection is lost.
+func (s *server) IsListening() bool {
+	return atomic.LoadInt32(&s.listening) == listeningBound
+}
+
+// handleRemoteConn tunnels a connection accepted at the incoming address.
+func (s *server) handleRemoteConn(conn net.Conn) {
+	randId := s.addConn(conn, "", time.Now())
+	s.connLog(randId).Infof("Accepted a new remote connection")
+	s.openConnection(randId, "")
+}
+
+// readConnId reads the id of the connection a transfer connection is for. The transfer connection is closed on failure.
+func readConnId(transferConn net.Conn) (uint32, error) {
+	connId := uint32(0)
+	err := binary.Read(transferConn, binary.LittleEndian, &connId)
 	if err != nil {
-		log.Fatalf("Could not listen for remote connections. Is the addr: %s used already? Cause: %s", s.remoteConnFactory.GetAddress(), err)
-		return
+		log.With(logs.FieldPeerAddress, transferConn.RemoteAddr()).Errorf("Could not read the connection id of a transfer connection. Closing the transfer connection. Cause: %s", err)
+		transferConn.Close()
 	}
-	transferListener, err = s.transferConnFactory.Listen()
-	if err != nil {
-		log.Fatalf("Could not listen for transfer connections. Is the addr: %s used already? Cause: %s", "0.0.0.0:8888", err)
+	return connId, err
+}
+
+// proxyTransferConn proxies the transfer connection the agent opened for connection connId.
+func (s *server) proxyTransferConn(transferConn net.Conn, connId uint32) {
+	t := s.getTunnel(connId)
+	if t == nil {
+		log.With(logs.FieldConnId, connId).Errorf("Proxy cannot be created. Closing the transfer connection. Cause: could not find the remote connection")
+		metrics.OpenFailuresTotal.Inc("unknown_connection")
+		transferConn.Close()
 		return
 	}
+	remoteConn := t.conn
+	s.nextStep(t, "first_byte")
+	if hc, ok := remoteConn.(*handshakeConn); ok {
+		err := hc.reply(true)
+		if err != nil {
+			t.log.Warningf("Could not confirm the connection to its client. Closing the transfer connection. Cause: %s", err)
+			transferConn.Close()
+			return
+		}
+	}
+	serviceName, agentName := s.getIdentity()
+	metrics.ConnectionOpenSeconds.Observe(time.Since(t.accepted).Seconds(), serviceName, agentName)
+	metrics.ConnectionsTotal.Inc(serviceName, agentName)
+	metrics.ConnectionsActive.Inc(serviceName, agentName)
+	connProxy := connectivity.NewConnProxy(remoteConn, transferConn)
+	connProxy.SetLogFields(t.log.Fields()...)
+	idleTimeout, maxLifetime := s.connLimits.forService(serviceName)
+	connProxy.SetIdleTimeout(idleTimeout)
+	connProxy.SetMaxLifetime(maxLifetime)
+	var firstByte sync.Once
+	connProxy.SetOnTransferListener(func(aToB int, bToA int) {
+		firstByte.Do(func() {
+			t.getOwner().endTrace(t, "")
+		})
+		if aToB > 0 {
+			metrics.BytesTotal.Add(float64(aToB), metrics.DirectionIn, serviceName, agentName)
+		}
+		if bToA > 0 {
+			metrics.BytesTotal.Add(float64(bToA), metrics.DirectionOut, serviceName, agentName)
+		}
+	})
+	connProxy.SetOnFinishedListener(func(connA net.Conn, connB net.Conn, reason connectivity.CloseReason) {
+		metrics.ConnectionsActive.Dec(serviceName, agentName)
+		bytesIn, bytesOut := connProxy.GetBytesTransferred()
+		owner := t.getOwner()
+		closeReason := owner.logAccess(connId, t, proxyCloseReason(reason), bytesIn, bytesOut)
+		owner.endTrace(t, closeReason)
+		t.remove(connId)
+		events.Publish(events.Event{Type: events.ConnectionClosed, Agent: agentName, Service: serviceName,
+			ConnectionId: connId, ClientAddress: connA.RemoteAddr().String(), BytesIn: bytesIn, BytesOut: bytesOut,
+			Message: closeReason})
+	})
+	s.setProxy(connId, connProxy)
+	events.Publish(events.Event{Type: events.ConnectionOpened, Agent: agentName, Service: serviceName,
+		ConnectionId: connId, ClientAddress: remoteConn.RemoteAddr().String()})
+	connProxy.RunAsync()
+}
+
+func (s *server) agentAddress() string {
+	if s.controlConn == nil {
+		return "unknown"
+	}
+	return s.controlConn.RemoteAddr().String()
+}
 
-	log.Infof("Listening for remote connections")
+func (s *server) getServiceName() string {
+	s.identityMutex.Lock()
+	defer s.identityMutex.Unlock()
+	return s.serviceName
+}
 
-	go func() {
-		for {
-			conn, err := remoteListener.Accept()
-			if err != nil {
-				log.Errorf("Error while accepting remote connection. The listening has likely stopped. No more remote connections will be accepted. Cause: %s", err)
-				s.waitUntilFinished <- true
-				return
-			}
-			randId := rand.Uint32()
-			log.Infof("Accepted a new remote connection, assigning id: %d", randId)
-			s.localConns[randId] = conn
-			s.messenger.SendOpenConn(randId, 0)
-		}
-	}()
+// hasGreeted tells if the agent said hello, i.e. the control connection carries an agent rather than a probe.
+func (s *server) hasGreeted() bool {
+	s.identityMutex.Lock()
+	defer s.identityMutex.Unlock()
+	return s.greeted
+}
 
-	go func() {
-		for {
-			transferConn, err := transferListener.Accept()
-			if err != nil {
-				log.Errorf("Error while accepting transfer connection. The listening has likely stopped. No more transfer connections will be accepted. Cause: %s", err)
-				s.waitUntilFinished <- true
-				return
-			}
-			connId := uint32(0)
-			err = binary.Read(transferConn, binary.LittleEndian, &connId)
-			if err != nil {
-				log.Fatalf("Decode failed: %s", err)
-			}
-			remoteConn := s.localConns[connId]
-			if remoteConn == nil {
-				log.Errorf("Proxy cannot be created. Closing the transfer connection. Cause: could not find remote connection id: %d", connId)
-				transferConn.Close()
-			}
-			connProxy := connectivity.NewConnProxy(remoteConn, transferConn)
-			connProxy.SetOnFinishedListener(func(connA net.Conn, connB net.Conn) {
-				delete(s.localConns, connId)
-			})
-			connProxy.RunAsync()
-		}
-	}()
+// allows tells if the agent's LAN allow-list may permit a SOCKS5 destination.
+func (s *server) allows(destination string, resolved []net.IP) bool {
+	s.identityMutex.Lock()
+	defer s.identityMutex.Unlock()
+	return s.allowList.Matches(destination, resolved)
+}
+
+func (s *server) getIdentity() (string, string) {
+	s.identityMutex.Lock()
+	defer s.identityMutex.Unlock()
+	return s.serviceName, s.agentName
+}
+
+func (s *server) addConn(conn net.Conn, destination string, accepted time.Time) uint32 {
+	id := rand.Uint32()
+	for s.hub != nil && s.hub.owner(id) != nil {
+		id = rand.Uint32()
+	}
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	for s.localConns[id] != nil {
+		id = rand.Uint32()
+	}
+	s.identityMutex.Lock()
+	serviceName, agentName := s.serviceName, s.agentName
+	s.identityMutex.Unlock()
+	t := &tunnel{
+		conn:        conn,
+		destination: destination,
+		accepted:    accepted,
+		log: log.With(logs.FieldConnId, id, logs.FieldService, serviceName, logs.FieldAgent, agentName,
+			logs.FieldClientAddress, conn.RemoteAddr()),
+		owner: s,
+	}
+	s.startTrace(t, id, serviceName, agentName)
+	s.localConns[id] = t
+	return id
+}
+
+// connLog returns the logger of connection id, carrying its fields.
+func (s *server) connLog(id uint32) *logs.Logger {
+	if t := s.getTunnel(id); t != nil {
+		return t.log
+	}
+	return log.With(logs.FieldConnId, id)
+}
+
+// agentLog returns a logger carrying the fields of the connected agent.
+func (s *server) agentLog() *logs.Logger {
+	serviceName, agentName := s.getIdentity()
+	return log.With(logs.FieldAgent, agentName, logs.FieldService, serviceName)
+}
+
+func (s *server) getConn(id uint32) net.Conn {
+	t := s.getTunnel(id)
+	if t == nil {
+		return nil
+	}
+	return t.conn
+}
+
+func (s *server) getTunnel(id uint32) *tunnel {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	return s.localConns[id]
+}
+
+func (s *server) getProxy(id uint32) connectivity.ConnProxy {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	if t := s.localConns[id]; t != nil {
+		return t.proxy
+	}
+	return nil
+}
+
+func (s *server) setProxy(id uint32, proxy connectivity.ConnProxy) {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	if t := s.localConns[id]; t != nil {
+		t.proxy = proxy
+	}
+}
+
+func (s *server) removeConn(id uint32) {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	delete(s.localConns, id)
+}
+
+// removeTunnel removes a tunnel unless its id has been taken by another one since.
+func (s *server) removeTunnel(id uint32, t *tunnel) {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	if s.localConns[id] == t {
+		delete(s.localConns, id)
+	}
+}
+
+// dropConn removes a connection that never got proxied and writes its access log record.
+func (s *server) dropConn(id uint32, reason string) {
+	t := s.getTunnel(id)
+	if t == nil {
+		return
+	}
+	reason = s.logAccess(id, t, reason, 0, 0)
+	s.endTrace(t, reason)
+	s.removeConn(id)
 }
 
 func (s *server) Wait() {
@@ -177,6 +537,13 @@ func (s *server) Wait() {
 	log.Info("The server has finished")
 }
 
+// finish signals Wait. Only the first call has an effect.
+func (s *server) finish() {
+	s.finishOnce.Do(func() {
+		close(s.waitUntilFinished)
+	})
+}
+
 func (s *server) startKeepAlive() {
 	go func() {
 		for {
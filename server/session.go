@@ -0,0 +1,172 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Sessions keeps the proxied connections of agents whose control connection was lost. An agent reconnecting with the
+// same session token (and the same name and certificate) within the resume timeout gets them re-attached; otherwise
+// they are closed.
+type Sessions interface {
+	suspend(token string, identity string, s *server)
+	resume(token string, identity string) *server
+}
+
+type sessions struct {
+	resumeTimeout time.Duration
+	suspended     map[string]*suspendedSession
+	mutex         sync.Mutex
+}
+
+type suspendedSession struct {
+	server   *server
+	identity string
+	timer    *time.Timer
+}
+
+func NewSessions(resumeTimeout time.Duration) Sessions {
+	return &sessions{
+		resumeTimeout: resumeTimeout,
+		suspended:     make(map[string]*suspendedSession),
+	}
+}
+
+func (ss *sessions) suspend(token string, identity string, s *server) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if previous := ss.suspended[token]; previous != nil {
+		previous.timer.Stop()
+		go previous.server.expireSession()
+	}
+	session := &suspendedSession{server: s, identity: identity}
+	session.timer = time.AfterFunc(ss.resumeTimeout, func() {
+		ss.mutex.Lock()
+		expired := ss.suspended[token] == session
+		if expired {
+			delete(ss.suspended, token)
+		}
+		ss.mutex.Unlock()
+		if expired {
+			s.expireSession()
+		}
+	})
+	ss.suspended[token] = session
+}
+
+// resume returns the server of a suspended session, or nil if there is none for the token and identity.
+func (ss *sessions) resume(token string, identity string) *server {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	session := ss.suspended[token]
+	if session == nil || session.identity != identity {
+		return nil
+	}
+	session.timer.Stop()
+	delete(ss.suspended, token)
+	return session.server
+}
+
+func (s *server) SetSessions(sessions Sessions) {
+	s.sessions = sessions
+}
+
+// sessionIdentity identifies the agent beyond its session token, so another agent cannot take over its connections.
+func (s *server) sessionIdentity() string {
+	_, agentName := s.getIdentity()
+	identity := agentName
+	if s.controlConn != nil {
+		if cert := peerCertificate(s.controlConn); cert != nil {
+			identity += "/" + cert.Subject.String()
+		}
+	}
+	return identity
+}
+
+// liveSession returns another connected server holding the session and supersedes it, which happens when the agent
+// reconnects before the loss of its old control connection was noticed. It returns nil if there is none, or if the old
+// server noticed the loss already and suspends the session itself.
+func (s *server) liveSession(token string, identity string) *server {
+	if s.registry == nil {
+		return nil
+	}
+	for _, other := range s.registry.GetServers() {
+		old, ok := other.(*server)
+		if !ok || old == s || old.sessionIdentity() != identity || !old.supersede(token) {
+			continue
+		}
+		return old
+	}
+	return nil
+}
+
+// supersede marks the server as replaced by a new control connection of its agent, if it holds the session and has
+// not lost its control connection yet. A superseded server leaves its proxied connections to be adopted and neither
+// suspends the session nor publishes events once its control connection is closed. Its connections that are not
+// proxied yet are closed, as the new agent connection knows nothing of them.
+func (s *server) supersede(token string) bool {
+	s.identityMutex.Lock()
+	if s.sessionToken != token || s.lost || s.superseded {
+		s.identityMutex.Unlock()
+		return false
+	}
+	s.superseded = true
+	s.identityMutex.Unlock()
+	if s.registry != nil {
+		s.registry.Unregister(s)
+	}
+	s.localConnsMutex.Lock()
+	var unproxied []uint32
+	for id, t := range s.localConns {
+		if t.proxy == nil {
+			t.closeReason = closeControlLost
+			unproxied = append(unproxied, id)
+			t.conn.Close()
+		}
+	}
+	s.localConnsMutex.Unlock()
+	for _, id := range unproxied {
+		s.dropConn(id, closeControlLost)
+	}
+	return true
+}
+
+// adopt moves the tunnels of a suspended or superseded server to this one and returns their number. Tunnels whose id
+// is already taken here are closed.
+func (s *server) adopt(old *server) int {
+	ownersMutex.Lock()
+	defer ownersMutex.Unlock()
+	old.localConnsMutex.Lock()
+	tunnels := old.localConns
+	old.localConns = make(map[uint32]*tunnel)
+	old.localConnsMutex.Unlock()
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	adopted := 0
+	for id, t := range tunnels {
+		if s.localConns[id] != nil {
+			t.log.Warningf("The connection id is taken by a new connection. Closing the resumed connection")
+			t.closeReason = closeControlLost
+			t.conn.Close()
+			continue
+		}
+		t.owner = s
+		s.localConns[id] = t
+		adopted++
+	}
+	return adopted
+}
+
+// expireSession closes the connections of a session that was not resumed in time.
+func (s *server) expireSession() {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	if len(s.localConns) == 0 {
+		return
+	}
+	s.agentLog().Warningf("The agent did not resume its session in time. Closing its %d remaining connections", len(s.localConns))
+	for _, t := range s.localConns {
+		t.closeReason = closeControlLost
+		t.conn.Close()
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net"
+	"time"
+	"project-proxy/connectivity"
+	"project-proxy/events"
+	"project-proxy/logs"
+	"project-proxy/metrics"
+)
+
+// Health of the local target of an agent, as its probes report it. Agents that do not probe stay unknown, which counts
+// as healthy.
+const (
+	TargetHealthUnknown   = "unknown"
+	TargetHealthHealthy   = "healthy"
+	TargetHealthUnhealthy = "unhealthy"
+)
+
+// onServiceHealth records the health the agent reported for its local target and tells the operators about changes.
+func (s *server) onServiceHealth(healthy bool, reason string, err error) {
+	if err != nil {
+		log.Errorf("Erroreous service health message. This message will be ignored. Cause: %s", err)
+		return
+	}
+	health := TargetHealthUnhealthy
+	if healthy {
+		health = TargetHealthHealthy
+		reason = ""
+	}
+	s.identityMutex.Lock()
+	previous := s.targetHealth
+	s.targetHealth = health
+	s.healthReason = reason
+	if health != previous {
+		s.healthChangedAt = time.Now()
+	}
+	agentName, serviceName := s.agentName, s.serviceName
+	s.identityMutex.Unlock()
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	metrics.TargetHealthy.Set(value, serviceName, agentName)
+	if health == previous {
+		return
+	}
+	if healthy {
+		s.agentLog().Infof("The local target of the agent is healthy")
+		if previous == TargetHealthUnhealthy {
+			events.Publish(events.Event{Type: events.TargetHealthy, Agent: agentName, Service: serviceName})
+		}
+		return
+	}
+	s.agentLog().Warningf("The local target of the agent is unhealthy. New connections for it will be refused. Cause: %s", reason)
+	events.Publish(events.Event{Type: events.TargetUnhealthy, Agent: agentName, Service: serviceName,
+		Message: reason})
+}
+
+// isTargetHealthy tells if the local target of the agent may take new connections, which it may unless the agent
+// reported it unhealthy.
+func (s *server) isTargetHealthy() bool {
+	s.identityMutex.Lock()
+	defer s.identityMutex.Unlock()
+	return s.targetHealth != TargetHealthUnhealthy
+}
+
+// refuseUnhealthy closes a connection the agent cannot take because its local target is unhealthy.
+func refuseUnhealthy(conn net.Conn, serviceName string) {
+	log.With(logs.FieldClientAddress, conn.RemoteAddr()).Warningf("The local target of service: %q is unhealthy. Closing the connection", serviceName)
+	metrics.OpenFailuresTotal.Inc("target_unhealthy")
+	conn.Close()
+}
+
+// rejectUnhealthy tells a client that its service is known but unavailable as its local target is unhealthy.
+func rejectUnhealthy(conn net.Conn, serviceName string) {
+	connectivity.WriteServiceResponse(conn, connectivity.ServiceUnavailable)
+	refuseUnhealthy(conn, serviceName)
+}
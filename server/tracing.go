@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"project-proxy/tracing"
+	"time"
+)
+
+// The setup of every tunnel is traced as a "tunnel.setup" span, starting when the client connection was
+// accepted and ending with the first proxied byte. Its steps are child spans:
+//
+//	client.handshake   SOCKS5 or service request handshake
+//	open_connection    from sending OpenConnection until the agent's transfer connection arrives; the agent's
+//	                   spans are its children
+//	first_byte         from proxying until the first byte flows either way
+
+func (s *server) startTrace(t *tunnel, id uint32, serviceName string, agentName string) {
+	t.span = tracing.StartSpanAt("tunnel.setup", tracing.KindServer, tracing.SpanContext{}, t.accepted)
+	t.span.SetAttribute("conn_id", id)
+	t.span.SetAttribute("client.address", t.conn.RemoteAddr().String())
+	t.span.SetAttribute("service", serviceName)
+	t.span.SetAttribute("agent", agentName)
+	if t.destination != "" {
+		t.span.SetAttribute("destination", t.destination)
+	}
+}
+
+// traceHandshake records the handshake a client went through before its connection was added.
+func (s *server) traceHandshake(id uint32, protocol string, started time.Time) {
+	t := s.getTunnel(id)
+	if t == nil {
+		return
+	}
+	span := tracing.StartSpanAt("client.handshake", tracing.KindInternal, t.span.Context(), started)
+	span.SetAttribute("protocol", protocol)
+	span.End()
+}
+
+// openConnection asks the agent to open the connection, passing the trace context along.
+func (s *server) openConnection(id uint32, destination string) {
+	t := s.getTunnel(id)
+	if t == nil {
+		return
+	}
+	step := t.span.StartChild("open_connection", tracing.KindClient)
+	s.setStep(t, step)
+	err := s.messenger.SendOpenConn(id, 0, destination, step.Context().TraceParent())
+	if err != nil {
+		step.EndWithError(err)
+	}
+}
+
+func (s *server) setStep(t *tunnel, step *tracing.Span) *tracing.Span {
+	s.localConnsMutex.Lock()
+	defer s.localConnsMutex.Unlock()
+	previous := t.step
+	t.step = step
+	return previous
+}
+
+// nextStep ends the current step of a tunnel's setup and starts the next one.
+func (s *server) nextStep(t *tunnel, name string) {
+	s.setStep(t, t.span.StartChild(name, tracing.KindInternal)).End()
+}
+
+// endTrace ends the setup trace, as failed if the tunnel was closed before any byte was proxied.
+func (s *server) endTrace(t *tunnel, reason string) {
+	step := s.setStep(t, nil)
+	if reason == "" {
+		step.End()
+		t.span.End()
+		return
+	}
+	err := errors.New("closed before the first byte: " + reason)
+	step.EndWithError(err)
+	t.span.EndWithError(err)
+}
@@ -0,0 +1,238 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"project-proxy/logs"
+)
+
+var log = logs.GetLoggerForModule("tracing")
+
+// Exporter ships finished spans, encoded as an OTLP/JSON ExportTraceServiceRequest.
+type Exporter interface {
+	Export(request []byte) error
+}
+
+const (
+	queueSize     = 4096
+	maxBatchSize  = 256
+	batchInterval = 5 * time.Second
+)
+
+var (
+	exporterMutex sync.RWMutex
+	queue         chan *Span
+)
+
+// Enabled tells whether an exporter is set. Without one no spans are recorded.
+func Enabled() bool {
+	exporterMutex.RLock()
+	defer exporterMutex.RUnlock()
+	return queue != nil
+}
+
+// SetExporter enables tracing. Finished spans are batched and exported in the background, under the given
+// OTLP service name.
+func SetExporter(exporter Exporter, serviceName string) {
+	exporterMutex.Lock()
+	defer exporterMutex.Unlock()
+	queue = make(chan *Span, queueSize)
+	go runBatches(queue, exporter, serviceName)
+}
+
+// NewExporter creates an OTLP/HTTP exporter for an http(s) URL, e.g. http://127.0.0.1:4318/v1/traces, and a
+// file exporter writing one request per line for anything else.
+func NewExporter(target string) (Exporter, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &otlpExporter{url: target, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: file}, nil
+}
+
+func export(s *Span) {
+	exporterMutex.RLock()
+	defer exporterMutex.RUnlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- s:
+	default:
+		log.Warningf("The span queue is full. Dropping span: %s", s.name)
+	}
+}
+
+func runBatches(queue chan *Span, exporter Exporter, serviceName string) {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := exporter.Export(encodeRequest(batch, serviceName))
+		if err != nil {
+			log.Warningf("Could not export %d spans. Cause: %s", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-queue:
+			batch = append(batch, s)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+type fileExporter struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func (e *fileExporter) Export(request []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.file.Write(append(request, '\n'))
+	return err
+}
+
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *otlpExporter) Export(request []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("the collector answered " + resp.Status + ": " + string(body))
+	}
+	return nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func encodeRequest(spans []*Span, serviceName string) []byte {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = "project-proxy"
+	for _, s := range spans {
+		scopeSpans.Spans = append(scopeSpans.Spans, encodeSpan(s))
+	}
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpAttribute{encodeAttribute("service.name", serviceName)}
+	encoded, _ := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	return encoded
+}
+
+func encodeSpan(s *Span) otlpSpan {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		span.Attributes = append(span.Attributes, encodeAttribute(a.key, a.value))
+	}
+	if s.err != "" {
+		span.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return span
+}
+
+func encodeAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int, int32, int64, uint, uint16, uint32, uint64:
+		s := fmt.Sprint(v)
+		a.Value.IntValue = &s
+	case float32:
+		f := float64(v)
+		a.Value.DoubleValue = &f
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
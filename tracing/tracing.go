@@ -0,0 +1,158 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, numbered as in OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// TraceParent formats the context as a W3C traceparent header value.
+func (c SpanContext) TraceParent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(c.TraceID[:]), hex.EncodeToString(c.SpanID[:]))
+}
+
+// ParseTraceParent parses a W3C traceparent header value. An empty value gives an invalid context and no error.
+func ParseTraceParent(traceParent string) (SpanContext, error) {
+	var c SpanContext
+	if traceParent == "" {
+		return c, nil
+	}
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return c, errors.New("malformed traceparent: " + traceParent)
+	}
+	_, err := hex.Decode(c.TraceID[:], []byte(parts[1]))
+	if err == nil {
+		_, err = hex.Decode(c.SpanID[:], []byte(parts[2]))
+	}
+	if err != nil {
+		return SpanContext{}, errors.New("malformed traceparent: " + traceParent)
+	}
+	return c, nil
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is one timed step. All methods are safe to call on a nil span, which is what StartSpan returns while
+// tracing is disabled, so callers need no checks of their own.
+type Span struct {
+	name    string
+	kind    int
+	context SpanContext
+	parent  SpanID
+	start   time.Time
+	end     time.Time
+	mutex   sync.Mutex
+	attrs   []attribute
+	err     string
+	ended   bool
+}
+
+// StartSpan starts a span as a child of parent, or as the root of a new trace if parent is invalid.
+func StartSpan(name string, kind int, parent SpanContext) *Span {
+	return StartSpanAt(name, kind, parent, time.Now())
+}
+
+// StartSpanAt starts a span that began at a time already in the past, e.g. when a connection was accepted.
+func StartSpanAt(name string, kind int, parent SpanContext, start time.Time) *Span {
+	if !Enabled() {
+		return nil
+	}
+	s := &Span{name: name, kind: kind, start: start}
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+	}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// StartChild starts a span that is a child of s.
+func (s *Span) StartChild(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	return StartSpan(name, kind, s.context)
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed, unless it has already ended.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.ended {
+		s.err = err.Error()
+	}
+}
+
+// End finishes the span and hands it to the exporter. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+	export(s)
+}
+
+// EndWithError is SetError followed by End.
+func (s *Span) EndWithError(err error) {
+	s.SetError(err)
+	s.End()
+}
@@ -0,0 +1,4 @@
+package version
+
+// Version is set at build time with -ldflags "-X project-proxy/version.Version=...".
+var Version = "dev"